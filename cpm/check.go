@@ -0,0 +1,141 @@
+/*
+Package cpm of H-8/H-89 disk reader
+*/
+package cpm
+
+import (
+	"fmt"
+	"sort"
+)
+
+// problems found while checking a volume
+type checker struct {
+	problems []string
+}
+
+func (c *checker) report(format string, args ...interface{}) {
+	c.problems = append(c.problems, fmt.Sprintf(format, args...))
+}
+
+// entry number within the file, from the extent bytes
+func (entry DirectoryEntry) entryNumber(dpb DiskParameterBlock) int {
+	extent := int(entry.S2)*32 + int(entry.Extent)
+
+	return extent / (dpb.EXM + 1)
+}
+
+// report missing and repeated entry numbers of one file
+func (c *checker) checkExtents(filename string, numbers []int) {
+	sort.Ints(numbers)
+
+	expected := 0
+	for i, number := range numbers {
+		if i > 0 && number == numbers[i-1] {
+			c.report("%s: extent %d appears more than once", filename, number)
+			continue
+		}
+
+		for expected < number {
+			c.report("%s: extent %d is missing", filename, expected)
+			expected += 1
+		}
+
+		expected = number + 1
+	}
+}
+
+// Check validates the directory and block allocation, and returns the problems found
+func Check(data []byte, dpb DiskParameterBlock) []string {
+	volume := Volume{}
+	err := volume.Init(data, dpb)
+	if err != nil {
+		return []string{"Directory: " + err.Error()}
+	}
+
+	return volume.check()
+}
+
+func (volume Volume) check() []string {
+	c := checker{}
+	dpb := volume.dpb
+
+	directoryBlocks := map[int]bool{}
+	for _, block := range dpb.directoryBlocks() {
+		directoryBlocks[block] = true
+	}
+
+	// which file owns each block
+	owners := map[int]string{}
+
+	// entry numbers of each file, in directory order of first appearance
+	filenames := []string{}
+	extents := map[string][]int{}
+
+	for i, entry := range volume.directoryEntries() {
+		// 0xE5 is unused, higher users are labels and time stamps
+		if entry.User >= 32 {
+			continue
+		}
+
+		if !printableName(entry.Name[:]) || !printableName(entry.Extension[:]) {
+			c.report("Entry %d: name %q is not printable", i, string(stripHighBit(entry.Name[:]))+"."+string(stripHighBit(entry.Extension[:])))
+			continue
+		}
+
+		filename := volume.fileSpec(int(entry.User), entry.nameToText())
+
+		if entry.RecordCount > 128 {
+			c.report("%s: record count %d is over 128", filename, entry.RecordCount)
+		}
+
+		_, ok := extents[filename]
+		if !ok {
+			filenames = append(filenames, filename)
+		}
+		extents[filename] = append(extents[filename], entry.entryNumber(dpb))
+
+		beyond := false
+		for _, block := range entry.allocationBlocks(dpb) {
+			if block > dpb.DSM {
+				c.report("%s: block %d is beyond DSM (%d)", filename, block, dpb.DSM)
+				beyond = true
+			} else if directoryBlocks[block] {
+				c.report("%s: block %d is in the directory", filename, block)
+			} else if owner, ok := owners[block]; ok {
+				c.report("Block %d is used by %s and %s", block, owner, filename)
+			} else {
+				owners[block] = filename
+			}
+		}
+
+		// a block beyond DSM is reported once, above
+		if entry.RecordCount <= 128 && !beyond {
+			_, err := allRecords(entry.usedBlocks(dpb), entry.recordCount(dpb), dpb)
+			if err != nil {
+				c.report("%s: %s", filename, err.Error())
+			}
+		}
+	}
+
+	for _, filename := range filenames {
+		c.checkExtents(filename, extents[filename])
+	}
+
+	return c.problems
+}
+
+func checkCommand(volume Volume) {
+	problems := volume.check()
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+
+	if len(problems) == 0 {
+		fmt.Println("No problems found")
+	} else {
+		fmt.Printf("%d problem(s) found\n", len(problems))
+	}
+
+	fmt.Println()
+}
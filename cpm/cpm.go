@@ -5,9 +5,11 @@ package cpm
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"github.com/jfitz/h8d-examiner/utils"
-	"os"
+	"io/ioutil"
+	"strconv"
 	"strings"
 )
 
@@ -18,41 +20,19 @@ func help() {
 	fmt.Println("dir    - list files on disk")
 	fmt.Println("type   - display contents of file")
 	fmt.Println("dump   - dump contents of file")
-	fmt.Println("export - copy file to your filesystem")
+	fmt.Println("export - copy file(s) to your filesystem (* and ? allowed)")
+	fmt.Println("import - copy file from your filesystem (import FILE [U:NAME.EXT [FLAGS]])")
+	fmt.Println("era    - erase file (era U:NAME.EXT)")
+	fmt.Println("ren    - rename file (ren U:NAME.EXT NEW.EXT)")
+	fmt.Println("set    - set file attributes W, S, A (set U:NAME.EXT [+-]FLAGS)")
+	fmt.Println("init   - write a blank volume (init [TEMPLATE], system tracks from TEMPLATE image)")
+	fmt.Println("check  - check directory and block allocation for problems")
+	fmt.Println("repair - write a repaired copy to your filesystem (repair FILE)")
+	fmt.Println("user   - show or set default user area")
+	fmt.Println("metadata - show or set export metadata (none, sidecar, manifest)")
 	fmt.Println("exit   - exit to main level")
 }
 
-func sectorsToRecords(sectorIndexes []int, recordsPerSector int) []int {
-	recordIndexes := []int{}
-
-	for _, sectorIndex := range sectorIndexes {
-		recordIndex := sectorIndex * recordsPerSector
-
-		for i := 0; i < recordsPerSector; i++ {
-			recordIndexes = append(recordIndexes, recordIndex)
-
-			recordIndex += 1
-		}
-	}
-
-	return recordIndexes
-}
-
-func blockToSectors(block int, sectorsPerBlock int, sectorMap [][]int, blocksPerMap, dirBase int) []int {
-	index := block % blocksPerMap
-	track := (block / blocksPerMap) * sectorsPerBlock
-	offsetsInBlock := sectorMap[index]
-
-	sectorIndexes := []int{}
-	for _, offsetInBlock := range offsetsInBlock {
-		sectorIndex := dirBase + track + offsetInBlock
-
-		sectorIndexes = append(sectorIndexes, sectorIndex)
-	}
-
-	return sectorIndexes
-}
-
 type SectorAndOffset struct {
 	Sector int
 	Offset int
@@ -131,46 +111,28 @@ func specialFlagsToText(flags []bool) string {
 }
 
 // return all record numbers for a file
-func allRecords(blocks []int, recordCount int, diskGeometry utils.DiskGeometry, diskType utils.DiskType) []int {
-	sectorsPerBlock := 20
-	directoryFirstSector := 30
-	recordsPerSector := 2
-	blocksPerMap := 5
-	sectorMap := [][]int{}
-
-	if diskType == utils.H37 {
-		sectorMap = [][]int{
-			{0, 3, 6, 9},
-			{2, 5, 8, 1},
-			{4, 7, 10, 13},
-			{16, 19, 12, 15},
-			{18, 11, 14, 17},
-		}
-	}
-
-	if diskType == utils.H17 {
-		sectorMap = [][]int{
-			{0, 4, 8, 2},
-			{6, 1, 5, 9},
-			{3, 7, 10, 14},
-			{18, 12, 16, 11},
-			{15, 19, 13, 17},
-		}
-	}
-
+func allRecords(blocks []int, recordCount int, dpb DiskParameterBlock) ([]int, error) {
 	records := []int{}
+	lastBlock := dpb.DSM
 
 	for _, block := range blocks {
-		blockSectors := blockToSectors(block, sectorsPerBlock, sectorMap, blocksPerMap, directoryFirstSector)
-		blockRecords := sectorsToRecords(blockSectors, recordsPerSector)
+		if block > lastBlock {
+			return records, utils.AllocationBlockError{Block: block, LastBlock: lastBlock}
+		}
+
+		blockRecords := dpb.blockRecords(block)
 		records = append(records, blockRecords...)
 	}
 
+	if recordCount > len(records) {
+		return records, utils.RecordCountError{RecordCount: recordCount, MaxRecords: len(records)}
+	}
+
 	if recordCount > 0 {
 		records = records[:recordCount]
 	}
 
-	return records
+	return records, nil
 }
 
 func recordsToText(records []int) string {
@@ -225,6 +187,13 @@ func (entry *DirectoryEntry) Init(bs []byte) {
 	}
 }
 
+// records in the entry, including full logical extents before the last one
+func (entry DirectoryEntry) recordCount(dpb DiskParameterBlock) int {
+	fullExtents := int(entry.Extent) & dpb.EXM
+
+	return fullExtents*128 + int(entry.RecordCount)
+}
+
 func (entry DirectoryEntry) normalName() bool {
 	byte1 := entry.Name[1] & 0x7F
 
@@ -296,32 +265,75 @@ func (entry DirectoryEntry) deletedEntryToText() string {
 	return text
 }
 
-func (entry DirectoryEntry) allocationBlocks() []int {
-	allocationBytes := utils.TrimSlice(entry.Blocks[:])
+// block numbers in all slots, 16 of 8 bits or (for more than 256 blocks) 8 of 16 bits
+func (entry DirectoryEntry) blockSlots(dpb DiskParameterBlock) []int {
+	blocks := []int{}
+
+	if dpb.DSM > 255 {
+		for i := 0; i < 16; i += 2 {
+			block := int(entry.Blocks[i]) + int(entry.Blocks[i+1])*256
+			blocks = append(blocks, block)
+		}
+	} else {
+		for _, b := range entry.Blocks {
+			blocks = append(blocks, int(b))
+		}
+	}
+
+	return blocks
+}
 
+// allocated blocks (block 0 holds the directory, so zero marks an unused slot)
+func (entry DirectoryEntry) allocationBlocks(dpb DiskParameterBlock) []int {
 	blocks := []int{}
 
-	for _, b := range allocationBytes {
-		blocks = append(blocks, int(b))
+	for _, block := range entry.blockSlots(dpb) {
+		if block != 0 {
+			blocks = append(blocks, block)
+		}
 	}
 
 	return blocks
 }
 
-// print detailed catalog from directory
-func catCommand(data []byte, directory []byte, details bool, diskGeometry utils.DiskGeometry, diskType utils.DiskType) {
-	fmt.Println("User Name          Extent Flags         Records Blocks")
+// blocks that hold the records of the entry, found from the record count
+// a 0 slot is a hole, not block 0 (always the directory), so the blocks end there
+func (entry DirectoryEntry) usedBlocks(dpb DiskParameterBlock) []int {
+	slots := entry.blockSlots(dpb)
+	recordsPerBlock := dpb.recordsPerBlock()
 
-	index := 0
-	entrySize := 32
+	slotCount := (entry.recordCount(dpb) + recordsPerBlock - 1) / recordsPerBlock
+	if slotCount > len(slots) {
+		slotCount = len(slots)
+	}
+
+	for i, block := range slots[:slotCount] {
+		if block == 0 {
+			return slots[:i]
+		}
+	}
+
+	return slots[:slotCount]
+}
+
+func statsCommand(volume Volume) {
+	volume.dpb.Print()
+	fmt.Printf("Allocation blocks: %d of %dK\n", volume.dpb.blockCount(), volume.dpb.blockSize()/1024)
+
+	freeSpace, err := volume.FreeSpace()
+	fmt.Printf("Free space: %dK\n", freeSpace/1024)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
 
-	for index < len(directory) {
-		end := index + entrySize
-		entry := DirectoryEntry{}
-		entry.Init(directory[index:end])
+	fmt.Println()
+}
 
-		// user := int(entry[0])
+// print detailed catalog from directory
+func catCommand(volume Volume, details bool) {
+	fmt.Println("User Name          Extent Flags         Records Blocks")
 
+	for _, entry := range volume.directoryEntries() {
 		// todo: user 0-31 print normal format
 		// todo: user 0xE5 print deleted format
 		// todo: else print alternate format
@@ -331,109 +343,76 @@ func catCommand(data []byte, directory []byte, details bool, diskGeometry utils.
 		// print block numbers and maybe record numbers
 		if entry.normalName() && entry.normalExtent() {
 			// block numbers
-			blocks := entry.allocationBlocks()
+			blocks := entry.allocationBlocks(volume.dpb)
 			fmt.Printf("   %02X", blocks)
 
 			if details {
 				// record numbers
 				fmt.Println()
-				recordCount := int(entry.RecordCount)
-				recordNumbers := allRecords(blocks, recordCount, diskGeometry, diskType)
+				usedBlocks := entry.usedBlocks(volume.dpb)
+				recordCount := entry.recordCount(volume.dpb)
+				recordNumbers, err := allRecords(usedBlocks, recordCount, volume.dpb)
 
 				recordText := recordsToText(recordNumbers)
 				fmt.Println(recordText)
+
+				if err != nil {
+					fmt.Println(err.Error())
+				}
 			}
 		}
 
 		fmt.Println()
-
-		index += entrySize
 	}
 
 	fmt.Println()
 }
 
 // print file-oriented directory (one line per file, not per entry)
-func dirCommand(data []byte, directory []byte, diskGeometry utils.DiskGeometry, diskType utils.DiskType) {
-	// for each user (0 to 31)
-	for user := 0; user < 32; user++ {
-		// get list of all file names with no repeats (strip flags)
-		index := 0
-		entrySize := 32
-
-		fileNames := []string{}
-		fileBlocks := map[string]int{}
-		fileFlags := map[string]string{}
+func dirCommand(volume Volume) {
+	fileEntries, err := volume.Entries()
 
-		print_user_header := true
+	user := -1
 
-		for index < len(directory) {
-			end := index + entrySize
-			entry := DirectoryEntry{}
-			entry.Init(directory[index:end])
+	for _, fileEntry := range fileEntries {
+		details := fileEntry.Sys.(FileDetails)
 
-			entryUser := int(entry.User)
+		if details.User != user {
+			user = details.User
 
-			if entryUser == user {
-				if print_user_header {
-					fmt.Println()
-					fmt.Printf("User: %d\n", entryUser)
-					fmt.Println("Name          Flags      Records")
-
-					print_user_header = false
-				}
-
-				// get filename
-				filename := entry.nameToText()
-
-				if _, ok := fileBlocks[filename]; ok {
-				} else {
-					fileNames = append(fileNames, filename)
-				}
-
-				if entry.Extent == 0 {
-					// extract flags from extension and name
-					name_flags := getHighBit(entry.Name[:])
-					extension_flags := getHighBit(entry.Extension[:])
-					flags := flagsToText(extension_flags) + specialFlagsToText(name_flags)
-					fileFlags[filename] = flags
-				}
-
-				// calculate size
-				blocks := entry.allocationBlocks()
-				recordCount := int(entry.RecordCount)
-				recordNumbers := allRecords(blocks, recordCount, diskGeometry, diskType)
-				fileBlocks[filename] += len(recordNumbers)
-			}
-
-			index += entrySize
+			fmt.Println()
+			fmt.Printf("User: %d\n", user)
+			fmt.Println("Name          Flags      Records")
 		}
 
 		// for each file, print info
-		for _, filename := range fileNames {
-			flags := fileFlags[filename]
-			size := fileBlocks[filename]
-			fmt.Printf("%-12s  %s %5d\n", filename, flags, size)
-		}
+		flags := details.flagsToText()
+		size := details.Records
+		fmt.Printf("%-12s  %s %5d\n", bareFilename(fileEntry.Name), flags, size)
+	}
+
+	if err != nil {
+		fmt.Println()
+		fmt.Println(err.Error())
 	}
 
 	fmt.Println()
 }
 
-func readRecord(data []byte, recordNumber int) ([]byte) {
+func readRecord(data []byte, recordNumber int) ([]byte, error) {
 	sectorNumber := recordNumber / 2
 	offset := recordNumber % 2
 
-	recordBytes := []byte{}
-	start1 := sectorNumber * 256
-	end1 := start1 + 256
-	sectorBytes := data[start1:end1]
+	sectorBytes, err := utils.GetSector(data, sectorNumber)
+	if err != nil {
+		return []byte{}, err
+	}
 
 	start := 0 + 128*offset
 	end := start + 128
-	recordBytes = sectorBytes[start:end]
+	recordBytes := sectorBytes[start:end]
 
-	return recordBytes
+	return recordBytes, nil
 }
 
 func displayText(bytes []byte) {
@@ -450,66 +429,14 @@ func displayText(bytes []byte) {
 	}
 }
 
-func displayRecords(data []byte, recordNumbers []int) {
-	// for each record in block
-	for _, record := range recordNumbers {
-		// read data
-		recordBytes := readRecord(data, record)
-
-		// print data
-		displayText(recordBytes)
-	}
-}
-
-func dumpRecords(data []byte, format string, recordNumbers []int) {
-	// for each record in block
-	for i, record := range recordNumbers {
-		fmt.Printf("RECORD: %d\n", i)
-		// read data
-		recordBytes := readRecord(data, record)
-
-		// print data
-		utils.Dump(recordBytes, i, format)
-		fmt.Println()
-	}
-}
-
-func exportRecords(data []byte, recordNumbers []int, filename string, exportDirectory string) {
-	fmt.Println("Exporting file...")
-
-	// open file
-	exportFilename := exportDirectory + "/" + filename
-	f, err := os.Create(exportFilename)
-	defer f.Close()
-
-	if err != nil {
-		fmt.Println("Cannot open file")
-		return
-	}
-
-	// for each record in block
-	for _, record := range recordNumbers {
-
-		// read data
-		recordBytes := readRecord(data, record)
-
-		if err != nil {
-			fmt.Println("Could not read record")
-		} else {
-			// print data
-			f.Write(recordBytes)
-		}
-	}
-
-	fmt.Println("Done")
-}
-
-func getRecordNumbers(data []byte, directory []byte, user int, name string, extension string, diskGeometry utils.DiskGeometry, diskType utils.DiskType) ([]int, bool) {
+func getRecordNumbers(data []byte, directory []byte, user int, name string, extension string, dpb DiskParameterBlock) ([]int, error) {
 	recordNumbers := []int{}
 
 	entrySize := 32
 
-	recordsPerBlock := 128
+	// one entry holds EXM+1 logical extents of 128 records
+	extentsPerEntry := dpb.EXM + 1
+	recordsPerEntry := extentsPerEntry * 128
 	done := false
 
 	anyFound := false
@@ -524,18 +451,25 @@ func getRecordNumbers(data []byte, directory []byte, user int, name string, exte
 			entry := DirectoryEntry{}
 			entry.Init(directory[index:end])
 
-			if int(entry.User) == user && entry.nameToText() == filename && int(entry.Extent) == extent {
+			// S2 counts blocks of 32 extents, for files over 512K
+			entryExtent := (int(entry.S2)*32 + int(entry.Extent)) &^ dpb.EXM
+
+			if int(entry.User) == user && entry.nameToText() == filename && entryExtent == extent {
 				found = true
 
-				blocks := entry.allocationBlocks()
-				recordCount := int(entry.RecordCount)
+				blocks := entry.usedBlocks(dpb)
+				recordCount := entry.recordCount(dpb)
 
-				// assume that the last block has a record count less than recordsPerBlock
-				if recordCount < recordsPerBlock {
+				// assume that the last entry has a record count less than recordsPerEntry
+				if recordCount < recordsPerEntry {
 					done = true
 				}
 
-				blockRecordNumbers := allRecords(blocks, recordCount, diskGeometry, diskType)
+				blockRecordNumbers, err := allRecords(blocks, recordCount, dpb)
+				if err != nil {
+					return recordNumbers, err
+				}
+
 				recordNumbers = append(recordNumbers, blockRecordNumbers...)
 			}
 
@@ -544,103 +478,201 @@ func getRecordNumbers(data []byte, directory []byte, user int, name string, exte
 
 		if found {
 			anyFound = true
-			extent += 1
+			extent += extentsPerEntry
 		} else {
 			done = true
 		}
 	}
 
-	return recordNumbers, anyFound
+	if !anyFound {
+		return recordNumbers, utils.ErrFileNotFound
+	}
+
+	return recordNumbers, nil
 }
 
-func splitFilename(filename string) (int, string, string) {
-	// split filename into user, file, and name
-	parts := strings.Split(filename, ".")
+// split a file specification (U:NAME.EXT, NAME.EXT or NAME) into user, name, and extension
+func splitFilename(filename string, defaultUser int) (int, string, string, error) {
+	user := defaultUser
+
+	// optional user number
+	parts := strings.SplitN(filename, ":", 2)
+	if len(parts) == 2 {
+		number, err := strconv.Atoi(parts[0])
+		if err != nil || number < 0 || number > 31 {
+			return user, "", "", errors.New("Bad user number in " + filename)
+		}
+
+		user = number
+		filename = parts[1]
+	}
+
+	// extension is optional
+	parts = strings.SplitN(filename, ".", 2)
 	name := parts[0]
-	// todo: file may have no extension
-	extension := parts[1]
-	// todo: split user from filename
-	user := 0
+	extension := ""
+	if len(parts) == 2 {
+		extension = parts[1]
+	}
+
+	if len(name) == 0 {
+		return user, name, extension, errors.New("File name required")
+	}
 
-	return user, name, extension
+	return user, name, extension, nil
 }
 
-func typeCommand(data []byte, directory []byte, filename string, diskGeometry utils.DiskGeometry, diskType utils.DiskType) {
-	user, name, extension := splitFilename(filename)
+// file name without the user number
+func bareFilename(filename string) string {
+	parts := strings.SplitN(filename, ":", 2)
+
+	return parts[len(parts)-1]
+}
+
+// the host file has no empty extension, and files of users other than 0
+// go in a subdirectory named for the user (3/NAME.EXT)
+func (volume Volume) hostFilename(filename string) string {
+	name := strings.TrimSuffix(bareFilename(filename), ".")
+
+	user, _, _, err := splitFilename(filename, volume.user)
+	if err != nil || user == 0 {
+		return name
+	}
+
+	return fmt.Sprintf("%d/%s", user, name)
+}
 
-	recordNumbers, found := getRecordNumbers(data, directory, user, name, extension, diskGeometry, diskType)
+func typeCommand(fileSystem utils.FileSystem, filename string) {
+	reader, err := fileSystem.Open(filename)
 
-	if found {
-		displayRecords(data, recordNumbers)
+	if err == nil {
+		contents, _ := ioutil.ReadAll(reader)
+		displayText(contents)
 	} else {
-		fmt.Println("File not found")
+		fmt.Println(err.Error())
 	}
 
 	fmt.Println()
 	fmt.Println()
 }
 
-func dumpCommand(data []byte, directory []byte, filename string, format string, diskGeometry utils.DiskGeometry, diskType utils.DiskType) {
-	user, name, extension := splitFilename(filename)
+func dumpCommand(fileSystem utils.FileSystem, filename string, format string) {
+	reader, err := fileSystem.Open(filename)
 
-	recordNumbers, found := getRecordNumbers(data, directory, user, name, extension, diskGeometry, diskType)
+	if err == nil {
+		contents, _ := ioutil.ReadAll(reader)
 
-	if found {
-		dumpRecords(data, format, recordNumbers)
+		// for each record in file
+		for i := 0; i*128 < len(contents); i++ {
+			fmt.Printf("RECORD: %d\n", i)
+			start := i * 128
+			end := start + 128
+			recordBytes := contents[start:end]
+
+			// print data
+			utils.Dump(recordBytes, i, format)
+			fmt.Println()
+		}
 	} else {
-		fmt.Println("File not found")
+		fmt.Println(err.Error())
 	}
 
 	fmt.Println()
 	fmt.Println()
 }
 
-func exportCommand(data []byte, directory []byte, filename string, exportDirectory string, diskGeometry utils.DiskGeometry, diskType utils.DiskType) {
-	user, name, extension := splitFilename(filename)
+func exportCommand(exporter *utils.Exporter, filename string) error {
+	var err error
 
-	recordNumbers, found := getRecordNumbers(data, directory, user, name, extension, diskGeometry, diskType)
+	if utils.HasWildcards(filename) {
+		fmt.Println("Exporting files...")
 
-	if found {
-		exportRecords(data, recordNumbers, filename, exportDirectory)
+		summary, exportErr := exporter.ExportFiles(filename)
+		summary.Print()
+		err = exportErr
 	} else {
-		fmt.Println("File not found")
+		fmt.Println("Exporting file...")
+
+		err = exporter.ExportFile(filename)
+		if err == nil {
+			fmt.Println("Done")
+		}
+	}
+
+	// write the manifest, even after a failure
+	closeErr := exporter.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		fmt.Println(err.Error())
 	}
 
 	fmt.Println()
-}
 
-func readDirectory(data []byte, diskGeometry utils.DiskGeometry, diskType utils.DiskType) ([]byte) {
-	blocks := []int{0, 1}
+	return err
+}
 
-	recordCount := -1
-	recordNumbers := allRecords(blocks, recordCount, diskGeometry, diskType)
+func readDirectory(data []byte, dpb DiskParameterBlock) ([]byte, error) {
+	blocks := dpb.directoryBlocks()
 
 	directory := make([]byte, 0)
+
+	// 32 bytes per entry, 4 entries per record
+	recordCount := (dpb.DRM + 1) / 4
+	recordNumbers, err := allRecords(blocks, recordCount, dpb)
+	if err != nil {
+		return directory, err
+	}
+
 	// for each record in block
 	for _, record := range recordNumbers {
 
 		// read data
-		recordBytes := readRecord(data, record)
+		recordBytes, err := readRecord(data, record)
+		if err != nil {
+			return directory, err
+		}
+
 		directory = append(directory, recordBytes...)
 	}
 
-	return directory
+	return directory, nil
 }
 
-func Export(data []byte, exportSpec string, exportDirectory string, diskGeometry utils.DiskGeometry, diskType utils.DiskType) {
-	directory := readDirectory(data, diskGeometry, diskType)
+func Export(data []byte, exportSpec string, exportDirectory string, metadataMode utils.MetadataMode, dpb DiskParameterBlock) error {
+	volume := Volume{}
+	err := volume.Init(data, dpb)
+	if err != nil {
+		return err
+	}
+
+	exporter := utils.Exporter{}
+	exporter.Init(volume, exportDirectory, volume.hostFilename, metadataMode)
 
-	exportCommand(data, directory, exportSpec, exportDirectory, diskGeometry, diskType)
+	return exportCommand(&exporter, exportSpec)
 }
 
-func Cat(data []byte, diskGeometry utils.DiskGeometry, diskType utils.DiskType) {
-	directory := readDirectory(data, diskGeometry, diskType)
+func Cat(data []byte, dpb DiskParameterBlock) error {
+	volume := Volume{}
+	err := volume.Init(data, dpb)
+	if err != nil {
+		return err
+	}
+
+	dirCommand(volume)
 
-	dirCommand(data, directory, diskGeometry, diskType)
+	return nil
 }
 
-func Menu(reader *bufio.Reader, data []byte, exportDirectory string, diskGeometry utils.DiskGeometry, diskType utils.DiskType) {
-	directory := readDirectory(data, diskGeometry, diskType)
+func Menu(reader *bufio.Reader, data []byte, exportDirectory string, metadataMode utils.MetadataMode, dpb DiskParameterBlock) error {
+	volume := Volume{}
+	err := volume.Init(data, dpb)
+	if err != nil {
+		return err
+	}
+
 	dump_format := "octal"
 
 	// prompt for command and process it
@@ -649,7 +681,9 @@ func Menu(reader *bufio.Reader, data []byte, exportDirectory string, diskGeometr
 		// display prompt and read command
 		fmt.Printf("CP/M> ")
 		line, err := reader.ReadString('\n')
-		utils.CheckAndExit(err)
+		if err != nil {
+			return err
+		}
 
 		// process the command
 		line = strings.TrimSpace(line)
@@ -659,17 +693,28 @@ func Menu(reader *bufio.Reader, data []byte, exportDirectory string, diskGeometr
 		if parts[0] == "exit" {
 			fmt.Println()
 			done = true
+		} else if parts[0] == "user" {
+			if len(parts) > 1 {
+				user, err := strconv.Atoi(parts[1])
+				if err == nil && user >= 0 && user <= 31 {
+					volume.user = user
+				} else {
+					fmt.Println("User must be 0 to 31")
+				}
+			}
+			fmt.Printf("Default user: %d\n", volume.user)
+			fmt.Println()
 		} else if parts[0] == "stats" {
-			fmt.Println("not implemented")
+			statsCommand(volume)
 		} else if parts[0] == "cat" {
-			catCommand(data, directory, false, diskGeometry, diskType)
+			catCommand(volume, false)
 		} else if parts[0] == "cats" {
-			catCommand(data, directory, true, diskGeometry, diskType)
+			catCommand(volume, true)
 		} else if parts[0] == "dir" {
-			dirCommand(data, directory, diskGeometry, diskType)
+			dirCommand(volume)
 		} else if parts[0] == "type" {
 			if len(parts) > 1 {
-				typeCommand(data, directory, parts[1], diskGeometry, diskType)
+				typeCommand(volume, parts[1])
 			} else {
 				fmt.Println("File name required")
 			}
@@ -679,19 +724,53 @@ func Menu(reader *bufio.Reader, data []byte, exportDirectory string, diskGeometr
 				if len(parts) > 2 {
 					format = parts[2]
 				}
-				dumpCommand(data, directory, parts[1], format, diskGeometry, diskType)
+				dumpCommand(volume, parts[1], format)
 			} else {
 				fmt.Println("File name required")
 			}
 		} else if parts[0] == "export" {
 			if len(parts) > 1 {
-				exportCommand(data, directory, parts[1], exportDirectory, diskGeometry, diskType)
+				exporter := utils.Exporter{}
+				exporter.Init(volume, exportDirectory, volume.hostFilename, metadataMode)
+				exportCommand(&exporter, parts[1])
 			} else {
 				fmt.Println("File name required")
 			}
+		} else if parts[0] == "import" {
+			hostFilename, options, err := importArguments(parts)
+			if err == nil {
+				importCommand(volume, hostFilename, options)
+			} else {
+				fmt.Println(err.Error())
+			}
+		} else if parts[0] == "era" {
+			eraCommand(volume, parts)
+		} else if parts[0] == "ren" {
+			renCommand(volume, parts)
+		} else if parts[0] == "set" {
+			setCommand(volume, parts)
+		} else if parts[0] == "init" {
+			initCommand(&volume, parts)
+		} else if parts[0] == "check" {
+			checkCommand(volume)
+		} else if parts[0] == "repair" {
+			repairCommand(volume, parts)
+		} else if parts[0] == "metadata" {
+			if len(parts) > 1 {
+				mode, err := utils.ParseMetadataMode(parts[1])
+				if err == nil {
+					metadataMode = mode
+				} else {
+					fmt.Println(err.Error())
+				}
+			}
+			fmt.Printf("Metadata: %s\n", metadataMode)
+			fmt.Println()
 		} else {
 			help()
 			fmt.Println()
 		}
 	}
+
+	return nil
 }
@@ -0,0 +1,182 @@
+/*
+Package cpm of H-8/H-89 disk reader
+*/
+package cpm
+
+func printableName(bs []byte) bool {
+	for _, b := range stripHighBit(bs) {
+		if b < 32 || b > 126 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// could this entry have been written by CP/M?
+func (entry DirectoryEntry) plausible(dpb DiskParameterBlock) bool {
+	// users 0-15, some systems allow up to 31
+	if entry.User > 31 {
+		return false
+	}
+
+	if !printableName(entry.Name[:]) || !printableName(entry.Extension[:]) {
+		return false
+	}
+
+	// first character of name is not a space
+	if entry.Name[0]&0x7F == ' ' {
+		return false
+	}
+
+	if entry.Extent > 31 || entry.RecordCount > 0x80 {
+		return false
+	}
+
+	// the first blocks hold the directory, zero means unused
+	directoryBlockCount := len(dpb.directoryBlocks())
+
+	for _, block := range entry.blockSlots(dpb) {
+		if (block > 0 && block < directoryBlockCount) || block > dpb.DSM {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Score rates how much an image looks like a CP/M volume, from 0.0 to 1.0
+func Score(data []byte, dpb DiskParameterBlock) float64 {
+	volume := Volume{}
+	err := volume.Init(data, dpb)
+	if err != nil {
+		return 0.0
+	}
+
+	entries := volume.directoryEntries()
+	empty := 0
+	valid := 0
+
+	for _, entry := range entries {
+		if entry.User == 0xE5 {
+			empty += 1
+		} else if entry.plausible(dpb) {
+			valid += 1
+		}
+	}
+
+	score := float64(empty+valid) / float64(len(entries))
+
+	// a directory with no files could be any freshly formatted disk,
+	// but one where every entry is unused (0xE5) is an empty CP/M directory
+	if valid == 0 && empty < len(entries) && score > 0.5 {
+		score = 0.5
+	}
+
+	return score
+}
+
+// Layout is a format chosen for a CP/M image, and how well it fits
+type Layout struct {
+	Format DiskParameterBlock
+	Score  float64
+}
+
+// formats that match the size of an image, or all of them for odd sizes
+func candidateFormats(imageSize int, formats []DiskParameterBlock) []DiskParameterBlock {
+	candidates := []DiskParameterBlock{}
+
+	for _, dpb := range formats {
+		if dpb.imageSize() == imageSize {
+			candidates = append(candidates, dpb)
+		}
+	}
+
+	if len(candidates) == 0 {
+		candidates = formats
+	}
+
+	return candidates
+}
+
+// is a record mostly text? (stops at CTRL-Z)
+func textRecord(bs []byte) bool {
+	printable := 0
+	count := 0
+
+	for _, b := range bs {
+		if b == 0x1A {
+			break
+		}
+
+		if (b >= 32 && b <= 126) || b == '\r' || b == '\n' || b == '\t' || b == '\f' {
+			printable += 1
+		}
+
+		count += 1
+	}
+
+	return count == 0 || float64(printable)/float64(count) > 0.9
+}
+
+// fraction of records in text files that read as text
+// a wrong skew table mixes records from other files into text files
+func (volume Volume) textScore() (float64, bool) {
+	fileEntries, _ := volume.Entries()
+
+	textRecords := 0
+	goodRecords := 0
+
+	for _, fileEntry := range fileEntries {
+		recordNumbers, err := volume.recordNumbers(fileEntry.Name)
+		if err != nil || len(recordNumbers) < 2 {
+			continue
+		}
+
+		// text files start with a text record
+		first, err := readRecord(volume.data, recordNumbers[0])
+		if err != nil || !textRecord(first) {
+			continue
+		}
+
+		for _, recordNumber := range recordNumbers[1:] {
+			recordBytes, err := readRecord(volume.data, recordNumber)
+			textRecords += 1
+			if err == nil && textRecord(recordBytes) {
+				goodRecords += 1
+			}
+		}
+	}
+
+	if textRecords == 0 {
+		return 0.0, false
+	}
+
+	return float64(goodRecords) / float64(textRecords), true
+}
+
+// DetectLayout tries each format and keeps the one that gives the most
+// consistent directory and the most readable text files
+func DetectLayout(data []byte, formats []DiskParameterBlock) Layout {
+	best := Layout{Score: -1.0}
+
+	for _, dpb := range candidateFormats(len(data), formats) {
+		layout := Layout{dpb, Score(data, dpb)}
+
+		volume := Volume{}
+		err := volume.Init(data, dpb)
+		if err == nil {
+			textScore, ok := volume.textScore()
+			if ok {
+				layout.Score *= textScore
+			}
+		}
+
+		// ties go to the earlier (more common) format
+		if layout.Score > best.Score {
+			best = layout
+		}
+	}
+
+	return best
+}
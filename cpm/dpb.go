@@ -0,0 +1,402 @@
+/*
+Package cpm of H-8/H-89 disk reader
+*/
+package cpm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jfitz/h8d-examiner/utils"
+	"io/ioutil"
+)
+
+// DiskParameterBlock is a CP/M disk format (the BIOS DPB plus the physical layout)
+type DiskParameterBlock struct {
+	Name        string
+	Description string
+	DiskType    utils.DiskType
+	Geometry    utils.DiskGeometry
+
+	SPT  int   // 128-byte records per track
+	BSH  int   // block shift (block size is 128 << BSH)
+	BLM  int   // block mask (records per block - 1)
+	EXM  int   // extent mask (logical extents per directory entry - 1)
+	DSM  int   // last allocation block
+	DRM  int   // last directory entry
+	AL0  byte  // directory blocks (bit 7 is block 0)
+	AL1  byte  // directory blocks (bit 7 is block 8)
+	OFF  int   // reserved (system) tracks
+	Skew []int // physical sector for each logical sector in a track
+}
+
+var h17Skew = []int{0, 4, 8, 2, 6, 1, 5, 9, 3, 7}
+var h37Skew = []int{0, 3, 6, 9, 2, 5, 8, 1, 4, 7}
+
+// images unpacked from IMD by sector number have the H-37 interleave undone
+var sequential10 = []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+var sequential16 = []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// Formats is the catalogue of known Heath/Zenith formats, most common first
+var Formats = []DiskParameterBlock{
+	{
+		Name:        "h17-sssd",
+		Description: "H-17 single-sided 40 track",
+		DiskType:    utils.H17,
+		Geometry:    utils.DiskGeometry{Sides: utils.SingleSided, Tracks: 40, SectorsPerTrack: 10, BytesPerSector: 256, SectorsPerTrack0: 10},
+		SPT:         20,
+		BSH:         3,
+		BLM:         7,
+		EXM:         0,
+		DSM:         91,
+		DRM:         63,
+		AL0:         0xC0,
+		AL1:         0x00,
+		OFF:         3,
+		Skew:        h17Skew,
+	},
+	{
+		Name:        "h37-sssd",
+		Description: "H-37 single-sided 40 track, H-17 compatible",
+		DiskType:    utils.H37,
+		Geometry:    utils.DiskGeometry{Sides: utils.SingleSided, Tracks: 40, SectorsPerTrack: 10, BytesPerSector: 256, SectorsPerTrack0: 10},
+		SPT:         20,
+		BSH:         3,
+		BLM:         7,
+		EXM:         0,
+		DSM:         91,
+		DRM:         63,
+		AL0:         0xC0,
+		AL1:         0x00,
+		OFF:         3,
+		Skew:        h37Skew,
+	},
+	{
+		Name:        "h17-dssd",
+		Description: "H-17 double-sided 40 track",
+		DiskType:    utils.H17,
+		Geometry:    utils.DiskGeometry{Sides: utils.DoubleSided, Tracks: 40, SectorsPerTrack: 10, BytesPerSector: 256, SectorsPerTrack0: 10},
+		SPT:         20,
+		BSH:         4,
+		BLM:         15,
+		EXM:         1,
+		DSM:         95,
+		DRM:         127,
+		AL0:         0xC0,
+		AL1:         0x00,
+		OFF:         3,
+		Skew:        h17Skew,
+	},
+	{
+		Name:        "h17-ss80",
+		Description: "H-17 single-sided 80 track",
+		DiskType:    utils.H17,
+		Geometry:    utils.DiskGeometry{Sides: utils.SingleSided, Tracks: 80, SectorsPerTrack: 10, BytesPerSector: 256, SectorsPerTrack0: 10},
+		SPT:         20,
+		BSH:         4,
+		BLM:         15,
+		EXM:         1,
+		DSM:         95,
+		DRM:         127,
+		AL0:         0xC0,
+		AL1:         0x00,
+		OFF:         3,
+		Skew:        h17Skew,
+	},
+	{
+		Name:        "h17-ds80",
+		Description: "H-17 double-sided 80 track",
+		DiskType:    utils.H17,
+		Geometry:    utils.DiskGeometry{Sides: utils.DoubleSided, Tracks: 80, SectorsPerTrack: 10, BytesPerSector: 256, SectorsPerTrack0: 10},
+		SPT:         20,
+		BSH:         4,
+		BLM:         15,
+		EXM:         1,
+		DSM:         195,
+		DRM:         127,
+		AL0:         0xC0,
+		AL1:         0x00,
+		OFF:         3,
+		Skew:        h17Skew,
+	},
+	{
+		Name:        "h37-ssdd",
+		Description: "H-37 single-sided 40 track double density",
+		DiskType:    utils.H37,
+		Geometry:    utils.DiskGeometry{Sides: utils.SingleSided, Tracks: 40, SectorsPerTrack: 16, BytesPerSector: 256, SectorsPerTrack0: 16},
+		SPT:         32,
+		BSH:         4,
+		BLM:         15,
+		EXM:         1,
+		DSM:         75,
+		DRM:         127,
+		AL0:         0xC0,
+		AL1:         0x00,
+		OFF:         2,
+		Skew:        []int{0, 3, 6, 9, 12, 15, 2, 5, 8, 11, 14, 1, 4, 7, 10, 13},
+	},
+	{
+		Name:        "h37-dsdd80",
+		Description: "H-37 double-sided 80 track double density",
+		DiskType:    utils.H37,
+		Geometry:    utils.DiskGeometry{Sides: utils.DoubleSided, Tracks: 80, SectorsPerTrack: 16, BytesPerSector: 256, SectorsPerTrack0: 16},
+		SPT:         32,
+		BSH:         4,
+		BLM:         15,
+		EXM:         0,
+		DSM:         315,
+		DRM:         255,
+		AL0:         0xF0,
+		AL1:         0x00,
+		OFF:         2,
+		Skew:        []int{0, 3, 6, 9, 12, 15, 2, 5, 8, 11, 14, 1, 4, 7, 10, 13},
+	},
+	{
+		Name:        "h37-sssd-id",
+		Description: "H-37 single-sided 40 track, H-17 compatible, sectors in ID order",
+		DiskType:    utils.H37,
+		Geometry:    utils.DiskGeometry{Sides: utils.SingleSided, Tracks: 40, SectorsPerTrack: 10, BytesPerSector: 256, SectorsPerTrack0: 10},
+		SPT:         20,
+		BSH:         3,
+		BLM:         7,
+		EXM:         0,
+		DSM:         91,
+		DRM:         63,
+		AL0:         0xC0,
+		AL1:         0x00,
+		OFF:         3,
+		Skew:        sequential10,
+	},
+	{
+		Name:        "h37-ssdd-id",
+		Description: "H-37 single-sided 40 track double density, sectors in ID order",
+		DiskType:    utils.H37,
+		Geometry:    utils.DiskGeometry{Sides: utils.SingleSided, Tracks: 40, SectorsPerTrack: 16, BytesPerSector: 256, SectorsPerTrack0: 16},
+		SPT:         32,
+		BSH:         4,
+		BLM:         15,
+		EXM:         1,
+		DSM:         75,
+		DRM:         127,
+		AL0:         0xC0,
+		AL1:         0x00,
+		OFF:         2,
+		Skew:        sequential16,
+	},
+	{
+		Name:        "h37-dsdd80-id",
+		Description: "H-37 double-sided 80 track double density, sectors in ID order",
+		DiskType:    utils.H37,
+		Geometry:    utils.DiskGeometry{Sides: utils.DoubleSided, Tracks: 80, SectorsPerTrack: 16, BytesPerSector: 256, SectorsPerTrack0: 16},
+		SPT:         32,
+		BSH:         4,
+		BLM:         15,
+		EXM:         0,
+		DSM:         315,
+		DRM:         255,
+		AL0:         0xF0,
+		AL1:         0x00,
+		OFF:         2,
+		Skew:        sequential16,
+	},
+	{
+		Name:        "h47-sssd",
+		Description: "H-47 8-inch single-sided single density",
+		DiskType:    utils.H47,
+		Geometry:    utils.DiskGeometry{Sides: utils.SingleSided, Tracks: 77, SectorsPerTrack: 26, BytesPerSector: 128, SectorsPerTrack0: 26},
+		SPT:         26,
+		BSH:         3,
+		BLM:         7,
+		EXM:         0,
+		DSM:         242,
+		DRM:         63,
+		AL0:         0xC0,
+		AL1:         0x00,
+		OFF:         2,
+		Skew:        []int{0, 6, 12, 18, 24, 4, 10, 16, 22, 2, 8, 14, 20, 1, 7, 13, 19, 25, 5, 11, 17, 23, 3, 9, 15, 21},
+	},
+}
+
+// FindFormat returns the format with a name
+func FindFormat(formats []DiskParameterBlock, name string) (DiskParameterBlock, error) {
+	for _, dpb := range formats {
+		if dpb.Name == name {
+			return dpb, nil
+		}
+	}
+
+	return DiskParameterBlock{}, errors.New("Unknown format " + name)
+}
+
+// ReadFormats reads format definitions (a JSON list of DiskParameterBlock) from a file
+func ReadFormats(fileName string) ([]DiskParameterBlock, error) {
+	formats := []DiskParameterBlock{}
+
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return formats, err
+	}
+
+	err = json.Unmarshal(contents, &formats)
+	if err != nil {
+		return formats, err
+	}
+
+	for _, dpb := range formats {
+		err = dpb.Check()
+		if err != nil {
+			return formats, err
+		}
+	}
+
+	return formats, nil
+}
+
+// Check reports a format whose values do not agree with each other
+func (dpb DiskParameterBlock) Check() error {
+	geometry := dpb.Geometry
+
+	if dpb.Name == "" {
+		return errors.New("Format has no name")
+	}
+
+	if geometry.BytesPerSector < 128 || geometry.BytesPerSector%128 != 0 {
+		return fmt.Errorf("Format %s: sector size %d is not a multiple of 128", dpb.Name, geometry.BytesPerSector)
+	}
+
+	if dpb.BSH < 3 || dpb.BSH > 7 || dpb.BLM != (1<<uint(dpb.BSH))-1 {
+		return fmt.Errorf("Format %s: BSH %d and BLM %d do not agree", dpb.Name, dpb.BSH, dpb.BLM)
+	}
+
+	if dpb.SPT != geometry.SectorsPerTrack*dpb.recordsPerSector() {
+		return fmt.Errorf("Format %s: SPT %d does not match %d sectors per track", dpb.Name, dpb.SPT, geometry.SectorsPerTrack)
+	}
+
+	if len(dpb.Skew) != geometry.SectorsPerTrack {
+		return fmt.Errorf("Format %s: skew table has %d sectors, not %d", dpb.Name, len(dpb.Skew), geometry.SectorsPerTrack)
+	}
+
+	for _, sector := range dpb.Skew {
+		if sector < 0 || sector >= geometry.SectorsPerTrack {
+			return fmt.Errorf("Format %s: skew table has bad sector %d", dpb.Name, sector)
+		}
+	}
+
+	if len(dpb.directoryBlocks()) == 0 {
+		return fmt.Errorf("Format %s: AL0 and AL1 reserve no directory blocks", dpb.Name)
+	}
+
+	if (dpb.DRM+1)*32 > len(dpb.directoryBlocks())*dpb.blockSize() {
+		return fmt.Errorf("Format %s: DRM %d does not fit in the directory blocks", dpb.Name, dpb.DRM)
+	}
+
+	// an entry holds EXM+1 logical extents of 16K, in 16 8-bit or 8 16-bit block slots
+	slots := 16
+	if dpb.DSM > 255 {
+		slots = 8
+	}
+
+	if dpb.EXM < 0 || (dpb.EXM+1)*16384/dpb.blockSize() > slots {
+		return fmt.Errorf("Format %s: EXM %d needs more than the %d block slots of an entry", dpb.Name, dpb.EXM, slots)
+	}
+
+	recordsOnDisk := (dpb.trackCount() - dpb.OFF) * dpb.SPT
+	if (dpb.DSM+1)*dpb.recordsPerBlock() > recordsOnDisk {
+		return fmt.Errorf("Format %s: DSM %d does not fit on the disk", dpb.Name, dpb.DSM)
+	}
+
+	return nil
+}
+
+func (dpb DiskParameterBlock) recordsPerSector() int {
+	return dpb.Geometry.BytesPerSector / 128
+}
+
+func (dpb DiskParameterBlock) recordsPerBlock() int {
+	return dpb.BLM + 1
+}
+
+func (dpb DiskParameterBlock) blockSize() int {
+	return 128 << uint(dpb.BSH)
+}
+
+func (dpb DiskParameterBlock) blockCount() int {
+	return dpb.DSM + 1
+}
+
+// both sides count as tracks
+func (dpb DiskParameterBlock) trackCount() int {
+	return dpb.Geometry.Tracks * int(dpb.Geometry.Sides)
+}
+
+// size of an image file for the format
+func (dpb DiskParameterBlock) imageSize() int {
+	geometry := dpb.Geometry
+	sectorCount := geometry.SectorsPerTrack0 + (dpb.trackCount()-1)*geometry.SectorsPerTrack
+
+	return sectorCount * geometry.BytesPerSector
+}
+
+// blocks reserved for the directory, from the AL0 and AL1 bit maps
+func (dpb DiskParameterBlock) directoryBlocks() []int {
+	blocks := []int{}
+	bits := int(dpb.AL0)<<8 + int(dpb.AL1)
+
+	for block := 0; block < 16; block++ {
+		if bits&(0x8000>>uint(block)) != 0 {
+			blocks = append(blocks, block)
+		}
+	}
+
+	return blocks
+}
+
+// offset in the image of the first byte of a track
+func (dpb DiskParameterBlock) trackStart(track int) int {
+	geometry := dpb.Geometry
+
+	if track == 0 {
+		return 0
+	}
+
+	sectorCount := geometry.SectorsPerTrack0 + (track-1)*geometry.SectorsPerTrack
+
+	return sectorCount * geometry.BytesPerSector
+}
+
+// convert a record number (from the start of the data tracks) to a
+// 128-byte record number in the image, through the skew table
+func (dpb DiskParameterBlock) imageRecord(record int) int {
+	track := dpb.OFF + record/dpb.SPT
+	recordInTrack := record % dpb.SPT
+	recordsPerSector := dpb.recordsPerSector()
+
+	logicalSector := recordInTrack / recordsPerSector
+	physicalSector := dpb.Skew[logicalSector]
+
+	offset := dpb.trackStart(track) + physicalSector*dpb.Geometry.BytesPerSector
+	offset += (recordInTrack % recordsPerSector) * 128
+
+	return offset / 128
+}
+
+// image record numbers of an allocation block
+func (dpb DiskParameterBlock) blockRecords(block int) []int {
+	records := []int{}
+	first := block * dpb.recordsPerBlock()
+
+	for i := 0; i < dpb.recordsPerBlock(); i++ {
+		records = append(records, dpb.imageRecord(first+i))
+	}
+
+	return records
+}
+
+// Print shows the format and its parameters
+func (dpb DiskParameterBlock) Print() {
+	fmt.Printf("Format: %s (%s)\n", dpb.Name, dpb.Description)
+	fmt.Printf("Disk type: %s\n", dpb.DiskType)
+	fmt.Printf("Sides: %d  Tracks: %d  Sectors: %d of %d bytes\n", int(dpb.Geometry.Sides), dpb.Geometry.Tracks, dpb.Geometry.SectorsPerTrack, dpb.Geometry.BytesPerSector)
+	fmt.Printf("SPT: %d  BSH: %d  BLM: %d  EXM: %d  DSM: %d  DRM: %d  AL0: %02XH  AL1: %02XH  OFF: %d\n", dpb.SPT, dpb.BSH, dpb.BLM, dpb.EXM, dpb.DSM, dpb.DRM, dpb.AL0, dpb.AL1, dpb.OFF)
+	fmt.Printf("Skew: %d\n", dpb.Skew)
+}
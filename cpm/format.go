@@ -0,0 +1,67 @@
+/*
+Package cpm of H-8/H-89 disk reader
+*/
+package cpm
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Format returns a blank CP/M volume, with the system tracks copied from a template image (if any)
+func Format(dpb DiskParameterBlock, template []byte) ([]byte, error) {
+	data := make([]byte, dpb.imageSize())
+
+	// system tracks (OFF) come before the data tracks
+	systemSize := dpb.trackStart(dpb.OFF)
+
+	if len(template) > 0 {
+		if len(template) < systemSize {
+			return []byte{}, fmt.Errorf("Template has %d bytes, system tracks need %d", len(template), systemSize)
+		}
+
+		copy(data[:systemSize], template[:systemSize])
+	}
+
+	// every data track is 0xE5, so the directory records are empty wherever the skew puts them
+	for i := systemSize; i < len(data); i++ {
+		data[i] = 0xE5
+	}
+
+	return data, nil
+}
+
+// write a blank volume over an image of the same format
+func initCommand(volume *Volume, parts []string) error {
+	var err error
+
+	template := []byte{}
+	if len(parts) > 1 {
+		template, err = ioutil.ReadFile(parts[1])
+	}
+
+	if err == nil && volume.dpb.imageSize() != len(volume.data) {
+		err = errors.New("Image is not the size of format " + volume.dpb.Name)
+	}
+
+	formatted := []byte{}
+	if err == nil {
+		formatted, err = Format(volume.dpb, template)
+	}
+
+	if err == nil {
+		copy(volume.data, formatted)
+		err = volume.Init(volume.data, volume.dpb)
+	}
+
+	if err == nil {
+		fmt.Printf("Initialized %s volume\n", volume.dpb.Name)
+	} else {
+		fmt.Println(err.Error())
+	}
+
+	fmt.Println()
+
+	return err
+}
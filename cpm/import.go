@@ -0,0 +1,389 @@
+/*
+Package cpm of H-8/H-89 disk reader
+*/
+package cpm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jfitz/h8d-examiner/utils"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// ImportOptions are the directory fields of an imported file
+type ImportOptions struct {
+	Name      string // U:NAME.EXT on the disk, empty to use the host file name
+	ReadOnly  bool
+	System    bool
+	Archived  bool
+	NameFlags [8]bool // F1-F8, the high bits of the name
+}
+
+// TextToFlags sets the attributes of options from flag letters (W, S, A as shown by cat)
+func TextToFlags(text string, options *ImportOptions) error {
+	for _, c := range strings.ToUpper(text) {
+		if c == 'W' {
+			options.ReadOnly = true
+		} else if c == 'S' {
+			options.System = true
+		} else if c == 'A' {
+			options.Archived = true
+		} else {
+			return errors.New("Flags must be W, S, or A")
+		}
+	}
+
+	return nil
+}
+
+// ImportOptions returns the options that write a file with this metadata
+func (metadata FileMetadata) ImportOptions() (ImportOptions, error) {
+	options := ImportOptions{Name: fmt.Sprintf("%d:%s", metadata.User, metadata.Name)}
+
+	// digits are the name attributes F1-F8
+	attributes := ""
+	for _, c := range metadata.Attributes {
+		if c >= '1' && c <= '8' {
+			options.NameFlags[c-'1'] = true
+		} else {
+			attributes += string(c)
+		}
+	}
+
+	err := TextToFlags(attributes, &options)
+
+	return options, err
+}
+
+func validName(text string, maxLength int) bool {
+	if len(text) > maxLength {
+		return false
+	}
+
+	for _, c := range text {
+		if c <= ' ' || c > '~' || strings.ContainsRune("<>.,;:=?*[]|", c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// convert NAME.EXT to directory fields, padded with spaces
+func nameToFields(name string, extension string) ([8]byte, [3]byte, error) {
+	nameField := [8]byte{}
+	extensionField := [3]byte{}
+
+	name = strings.ToUpper(name)
+	extension = strings.ToUpper(extension)
+
+	if !validName(name, 8) || !validName(extension, 3) {
+		return nameField, extensionField, errors.New("Bad CP/M file name " + name + "." + extension)
+	}
+
+	copy(nameField[:], name+strings.Repeat(" ", 8-len(name)))
+	copy(extensionField[:], extension+strings.Repeat(" ", 3-len(extension)))
+
+	return nameField, extensionField, nil
+}
+
+func (entry DirectoryEntry) bytes() []byte {
+	bs := make([]byte, 32)
+
+	bs[0] = entry.User
+	copy(bs[1:9], entry.Name[:])
+	copy(bs[9:12], entry.Extension[:])
+	bs[12] = entry.Extent
+	bs[13] = entry.S1
+	bs[14] = entry.S2
+	bs[15] = entry.RecordCount
+	copy(bs[16:32], entry.Blocks[:])
+
+	return bs
+}
+
+// store block numbers in the slots, 8-bit or 16-bit as the disk requires
+func (entry *DirectoryEntry) setBlocks(blocks []int, dpb DiskParameterBlock) error {
+	slots := 16
+	if dpb.DSM > 255 {
+		slots = 8
+	}
+
+	if len(blocks) > slots {
+		return utils.BlockSlotsError{Blocks: len(blocks), Slots: slots}
+	}
+
+	entry.Blocks = [16]byte{}
+
+	for i, block := range blocks {
+		if dpb.DSM > 255 {
+			entry.Blocks[i*2] = byte(block % 256)
+			entry.Blocks[i*2+1] = byte(block / 256)
+		} else {
+			entry.Blocks[i] = byte(block)
+		}
+	}
+
+	return nil
+}
+
+// blocks not used by the directory or by any file, lowest first
+func (volume Volume) freeBlocks() []int {
+	usedBlocks := map[int]bool{}
+
+	for _, block := range volume.dpb.directoryBlocks() {
+		usedBlocks[block] = true
+	}
+
+	for _, entry := range volume.directoryEntries() {
+		if entry.User < 32 {
+			for _, block := range entry.allocationBlocks(volume.dpb) {
+				usedBlocks[block] = true
+			}
+		}
+	}
+
+	blocks := []int{}
+	for block := 0; block < volume.dpb.blockCount(); block++ {
+		if !usedBlocks[block] {
+			blocks = append(blocks, block)
+		}
+	}
+
+	return blocks
+}
+
+// indexes of unused (0xE5) directory entries
+func (volume Volume) freeEntries() []int {
+	indexes := []int{}
+
+	for i, entry := range volume.directoryEntries() {
+		if entry.User == 0xE5 {
+			indexes = append(indexes, i)
+		}
+	}
+
+	return indexes
+}
+
+// write one directory entry to the image and to the directory copy
+func (volume Volume) writeEntry(index int, entry DirectoryEntry) error {
+	recordsPerEntry := 4
+	recordCount := (volume.dpb.DRM + 1) / recordsPerEntry
+
+	recordNumbers, err := allRecords(volume.dpb.directoryBlocks(), recordCount, volume.dpb)
+	if err != nil {
+		return err
+	}
+
+	bs := entry.bytes()
+
+	start := recordNumbers[index/recordsPerEntry]*128 + (index%recordsPerEntry)*32
+	copy(volume.data[start:start+32], bs)
+	copy(volume.directory[index*32:index*32+32], bs)
+
+	return nil
+}
+
+// write a file into the volume
+func (volume Volume) writeFile(contents []byte, options ImportOptions) error {
+	dpb := volume.dpb
+
+	user, name, extension, err := splitFilename(options.Name, volume.user)
+	if err != nil {
+		return err
+	}
+
+	nameField, extensionField, err := nameToFields(name, extension)
+	if err != nil {
+		return err
+	}
+
+	name = strings.ToUpper(name)
+	extension = strings.ToUpper(extension)
+
+	_, err = getRecordNumbers(volume.data, volume.directory, user, name, extension, dpb)
+	if err == nil {
+		return utils.ErrFileExists
+	}
+
+	if err != utils.ErrFileNotFound {
+		return err
+	}
+
+	// records of 128 bytes, the last one padded with CTRL-Z
+	recordCount := (len(contents) + 127) / 128
+	recordsPerBlock := dpb.recordsPerBlock()
+	blockCount := (recordCount + recordsPerBlock - 1) / recordsPerBlock
+
+	// one entry holds EXM+1 logical extents of 128 records
+	recordsPerEntry := (dpb.EXM + 1) * 128
+	entryCount := (recordCount + recordsPerEntry - 1) / recordsPerEntry
+	if entryCount == 0 {
+		entryCount = 1
+	}
+
+	freeBlocks := volume.freeBlocks()
+	if blockCount > len(freeBlocks) {
+		return utils.ErrDiskFull
+	}
+
+	freeEntries := volume.freeEntries()
+	if entryCount > len(freeEntries) {
+		return utils.ErrDirectoryFull
+	}
+
+	blocks := freeBlocks[:blockCount]
+
+	// copy the contents
+	for i, block := range blocks {
+		for j, record := range dpb.blockRecords(block) {
+			start := (i*recordsPerBlock + j) * 128
+			if start >= len(contents) {
+				break
+			}
+
+			end := start + 128
+			if end > len(contents) {
+				end = len(contents)
+			}
+
+			recordBytes := volume.data[record*128 : record*128+128]
+			n := copy(recordBytes, contents[start:end])
+			for k := n; k < 128; k++ {
+				recordBytes[k] = 0x1A
+			}
+		}
+	}
+
+	// attributes are the high bits of the extension
+	if options.ReadOnly {
+		extensionField[0] |= 0x80
+	}
+
+	if options.System {
+		extensionField[1] |= 0x80
+	}
+
+	if options.Archived {
+		extensionField[2] |= 0x80
+	}
+
+	for i, flag := range options.NameFlags {
+		if flag {
+			nameField[i] |= 0x80
+		}
+	}
+
+	blocksPerEntry := recordsPerEntry / recordsPerBlock
+
+	for i := 0; i < entryCount; i++ {
+		// records in this entry
+		records := recordCount - i*recordsPerEntry
+		if records > recordsPerEntry {
+			records = recordsPerEntry
+		}
+
+		// the extent number is the last logical extent in the entry
+		extent := i * (dpb.EXM + 1)
+		lastRecordCount := records
+		if records > 0 {
+			extent += (records - 1) / 128
+			lastRecordCount = records - ((records-1)/128)*128
+		}
+
+		entryBlocks := blocks[i*blocksPerEntry:]
+		if len(entryBlocks) > blocksPerEntry {
+			entryBlocks = entryBlocks[:blocksPerEntry]
+		}
+
+		entry := DirectoryEntry{
+			User:        byte(user),
+			Name:        nameField,
+			Extension:   extensionField,
+			Extent:      byte(extent % 32),
+			S2:          byte(extent / 32),
+			RecordCount: byte(lastRecordCount),
+		}
+		err = entry.setBlocks(entryBlocks, dpb)
+		if err != nil {
+			return err
+		}
+
+		err = volume.writeEntry(freeEntries[i], entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func importCommand(volume Volume, hostFilename string, options ImportOptions) error {
+	fmt.Println("Importing file...")
+
+	if len(options.Name) == 0 {
+		options.Name = filepath.Base(hostFilename)
+	}
+
+	contents, err := ioutil.ReadFile(hostFilename)
+	if err == nil {
+		err = volume.writeFile(contents, options)
+	}
+
+	if err == nil {
+		fmt.Println("Done")
+	} else {
+		fmt.Println(err.Error())
+	}
+
+	fmt.Println()
+
+	return err
+}
+
+// arguments of the import command: HOSTFILE [U:NAME.EXT [FLAGS]]
+func importArguments(parts []string) (string, ImportOptions, error) {
+	options := ImportOptions{}
+
+	if len(parts) < 2 {
+		return "", options, errors.New("File name required")
+	}
+
+	if len(parts) > 2 {
+		options.Name = parts[2]
+	}
+
+	if len(parts) > 3 {
+		err := TextToFlags(parts[3], &options)
+		if err != nil {
+			return "", options, err
+		}
+	}
+
+	return parts[1], options, nil
+}
+
+// Import copies a host file into the image data
+func Import(data []byte, hostFilename string, options ImportOptions, dpb DiskParameterBlock) error {
+	volume := Volume{}
+	err := volume.Init(data, dpb)
+	if err != nil {
+		return err
+	}
+
+	return importCommand(volume, hostFilename, options)
+}
+
+// WriteFile writes the contents of a file into the image data
+func WriteFile(data []byte, contents []byte, options ImportOptions, dpb DiskParameterBlock) error {
+	volume := Volume{}
+	err := volume.Init(data, dpb)
+	if err != nil {
+		return err
+	}
+
+	return volume.writeFile(contents, options)
+}
@@ -0,0 +1,239 @@
+/*
+Package cpm of H-8/H-89 disk reader
+*/
+package cpm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jfitz/h8d-examiner/utils"
+	"strings"
+)
+
+// indexes of every directory entry (extent) of a file
+func (volume Volume) fileIndexes(user int, name string, extension string) []int {
+	indexes := []int{}
+	filename := name + "." + extension
+
+	for i, entry := range volume.directoryEntries() {
+		if int(entry.User) == user && entry.nameToText() == filename {
+			indexes = append(indexes, i)
+		}
+	}
+
+	return indexes
+}
+
+// directory entries of a file, given as U:NAME.EXT
+func (volume Volume) findFile(filename string) ([]int, error) {
+	user, name, extension, err := splitFilename(strings.ToUpper(filename), volume.user)
+	if err != nil {
+		return []int{}, err
+	}
+
+	indexes := volume.fileIndexes(user, name, extension)
+	if len(indexes) == 0 {
+		return indexes, utils.ErrFileNotFound
+	}
+
+	return indexes, nil
+}
+
+// R/O files cannot be erased or renamed, as in CP/M
+func (volume Volume) readOnly(indexes []int) bool {
+	entries := volume.directoryEntries()
+
+	for _, index := range indexes {
+		if getHighBit(entries[index].Extension[:])[0] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mark every extent of a file as unused
+func (volume Volume) eraseFile(filename string) error {
+	indexes, err := volume.findFile(filename)
+	if err != nil {
+		return err
+	}
+
+	if volume.readOnly(indexes) {
+		return utils.ErrFileProtected
+	}
+
+	entries := volume.directoryEntries()
+
+	for _, index := range indexes {
+		entry := entries[index]
+		entry.User = 0xE5
+
+		err = volume.writeEntry(index, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rename every extent of a file, keeping the attribute bits
+func (volume Volume) renameFile(filename string, newFilename string) error {
+	indexes, err := volume.findFile(filename)
+	if err != nil {
+		return err
+	}
+
+	if volume.readOnly(indexes) {
+		return utils.ErrFileProtected
+	}
+
+	entries := volume.directoryEntries()
+
+	// the new name stays in the same user area unless it has a user number
+	user, name, extension, err := splitFilename(strings.ToUpper(newFilename), int(entries[indexes[0]].User))
+	if err != nil {
+		return err
+	}
+
+	nameField, extensionField, err := nameToFields(name, extension)
+	if err != nil {
+		return err
+	}
+
+	if len(volume.fileIndexes(user, name, extension)) > 0 {
+		return utils.ErrFileExists
+	}
+
+	for _, index := range indexes {
+		entry := entries[index]
+		entry.User = byte(user)
+
+		for i := range entry.Name {
+			entry.Name[i] = nameField[i] | (entry.Name[i] & 0x80)
+		}
+
+		for i := range entry.Extension {
+			entry.Extension[i] = extensionField[i] | (entry.Extension[i] & 0x80)
+		}
+
+		err = volume.writeEntry(index, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// set (+), clear (-) or replace the R/O, SYS and archive bits of every extent
+func (volume Volume) setAttributes(filename string, text string) (string, error) {
+	indexes, err := volume.findFile(filename)
+	if err != nil {
+		return "", err
+	}
+
+	mode := ""
+	if strings.HasPrefix(text, "+") || strings.HasPrefix(text, "-") {
+		mode = text[:1]
+		text = text[1:]
+	}
+
+	options := ImportOptions{}
+	err = TextToFlags(text, &options)
+	if err != nil {
+		return "", err
+	}
+
+	attributes := []bool{options.ReadOnly, options.System, options.Archived}
+
+	entries := volume.directoryEntries()
+	flags := []bool{}
+
+	for _, index := range indexes {
+		entry := entries[index]
+
+		for i, attribute := range attributes {
+			if mode == "" {
+				entry.Extension[i] &= 0x7F
+			}
+
+			if attribute && mode == "-" {
+				entry.Extension[i] &= 0x7F
+			} else if attribute {
+				entry.Extension[i] |= 0x80
+			}
+		}
+
+		err = volume.writeEntry(index, entry)
+		if err != nil {
+			return "", err
+		}
+
+		flags = getHighBit(entry.Extension[:])
+	}
+
+	return flagsToText(flags), nil
+}
+
+func eraCommand(volume Volume, parts []string) error {
+	var err error
+
+	if len(parts) == 2 {
+		err = volume.eraseFile(parts[1])
+	} else {
+		err = errors.New("File name required")
+	}
+
+	if err == nil {
+		fmt.Printf("Erased %s\n", strings.ToUpper(parts[1]))
+	} else {
+		fmt.Println(err.Error())
+	}
+
+	fmt.Println()
+
+	return err
+}
+
+func renCommand(volume Volume, parts []string) error {
+	var err error
+
+	if len(parts) == 3 {
+		err = volume.renameFile(parts[1], parts[2])
+	} else {
+		err = errors.New("Old and new file names required")
+	}
+
+	if err == nil {
+		fmt.Printf("Renamed %s to %s\n", strings.ToUpper(parts[1]), strings.ToUpper(parts[2]))
+	} else {
+		fmt.Println(err.Error())
+	}
+
+	fmt.Println()
+
+	return err
+}
+
+func setCommand(volume Volume, parts []string) error {
+	var err error
+	flags := ""
+
+	if len(parts) == 3 {
+		flags, err = volume.setAttributes(parts[1], strings.ToUpper(parts[2]))
+	} else {
+		err = errors.New("File name and flags required")
+	}
+
+	if err == nil {
+		fmt.Printf("%s: %s\n", strings.ToUpper(parts[1]), flags)
+	} else {
+		fmt.Println(err.Error())
+	}
+
+	fmt.Println()
+
+	return err
+}
@@ -0,0 +1,251 @@
+/*
+Package cpm of H-8/H-89 disk reader
+*/
+package cpm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jfitz/h8d-examiner/utils"
+	"sort"
+)
+
+// count what is wrong with an entry; the owner with more problems loses a shared block
+func (entry DirectoryEntry) problemCount(dpb DiskParameterBlock) int {
+	count := 0
+
+	if entry.RecordCount > 128 {
+		count += 1
+	}
+
+	if entry.Name[0]&0x7F == ' ' {
+		count += 1
+	}
+
+	directoryBlockCount := len(dpb.directoryBlocks())
+	for _, block := range entry.allocationBlocks(dpb) {
+		if block < directoryBlockCount || block > dpb.DSM {
+			count += 1
+		}
+	}
+
+	// the record count should need all of the blocks, and no more
+	recordsPerBlock := dpb.recordsPerBlock()
+	neededBlocks := (entry.recordCount(dpb) + recordsPerBlock - 1) / recordsPerBlock
+	if neededBlocks != len(entry.allocationBlocks(dpb)) {
+		count += 1
+	}
+
+	return count
+}
+
+// clear a block slot and the slots after it, so the records end before the block
+// (a hole would be read as block 0, the directory); returns the later blocks dropped
+func (entry *DirectoryEntry) releaseSlot(slot int, dpb DiskParameterBlock) ([]int, error) {
+	slots := entry.blockSlots(dpb)
+	dropped := []int{}
+
+	for i := slot; i < len(slots); i++ {
+		if i > slot && slots[i] != 0 {
+			dropped = append(dropped, slots[i])
+		}
+
+		slots[i] = 0
+	}
+
+	err := entry.setBlocks(slots, dpb)
+	if err != nil {
+		return dropped, err
+	}
+
+	records := entry.recordCount(dpb)
+	if records <= slot*dpb.recordsPerBlock() {
+		return dropped, nil
+	}
+
+	records = slot * dpb.recordsPerBlock()
+
+	// full logical extents go in the low bits of the extent
+	fullExtents := 0
+	if records > 0 {
+		fullExtents = (records - 1) / 128
+	}
+
+	entry.Extent = entry.Extent&^byte(dpb.EXM) | byte(fullExtents)
+	entry.RecordCount = byte(records - fullExtents*128)
+
+	return dropped, nil
+}
+
+// Repair returns a copy of the image with shared and invalid blocks released
+// and the extents of each file numbered in order, with a list of the changes
+func Repair(data []byte, dpb DiskParameterBlock) ([]byte, []string, error) {
+	changes := []string{}
+	repaired := append([]byte{}, data...)
+
+	volume := Volume{}
+	err := volume.Init(repaired, dpb)
+	if err != nil {
+		return repaired, changes, err
+	}
+
+	entries := volume.directoryEntries()
+	original := volume.directoryEntries()
+
+	directoryBlocks := map[int]bool{}
+	for _, block := range dpb.directoryBlocks() {
+		directoryBlocks[block] = true
+	}
+
+	// entries of files, by name, in directory order
+	filenames := []string{}
+	files := map[string][]int{}
+
+	// entries holding each block
+	owners := map[int][]int{}
+
+	for i, entry := range entries {
+		// 0xE5 is unused, higher users are labels and time stamps
+		if entry.User >= 32 || !printableName(entry.Name[:]) || !printableName(entry.Extension[:]) {
+			continue
+		}
+
+		filename := volume.fileSpec(int(entry.User), entry.nameToText())
+
+		_, ok := files[filename]
+		if !ok {
+			filenames = append(filenames, filename)
+		}
+		files[filename] = append(files[filename], i)
+
+		for _, block := range entry.allocationBlocks(dpb) {
+			owners[block] = append(owners[block], i)
+		}
+	}
+
+	entryName := func(i int) string {
+		entry := original[i]
+		return fmt.Sprintf("%s extent %d", volume.fileSpec(int(entry.User), entry.nameToText()), entry.entryNumber(dpb))
+	}
+
+	// the first problem stops the repair
+	release := func(i int, block int, reason string) {
+		records := entries[i].recordCount(dpb)
+		dropped := []int{}
+		found := false
+
+		for slot, slotBlock := range entries[i].blockSlots(dpb) {
+			if slotBlock == block && err == nil {
+				dropped, err = entries[i].releaseSlot(slot, dpb)
+				found = true
+			}
+		}
+
+		// already dropped with an earlier block of the entry
+		if !found {
+			return
+		}
+
+		changes = append(changes, fmt.Sprintf("%s: block %d released (%s)", entryName(i), block, reason))
+
+		if len(dropped) > 0 {
+			changes = append(changes, fmt.Sprintf("%s: blocks %v after it released", entryName(i), dropped))
+		}
+
+		if entries[i].recordCount(dpb) != records {
+			changes = append(changes, fmt.Sprintf("%s: records %d -> %d", entryName(i), records, entries[i].recordCount(dpb)))
+		}
+	}
+
+	blocks := []int{}
+	for block := range owners {
+		blocks = append(blocks, block)
+	}
+	sort.Ints(blocks)
+
+	for _, block := range blocks {
+		indexes := owners[block]
+
+		if block > dpb.DSM {
+			for _, i := range indexes {
+				release(i, block, "beyond DSM")
+			}
+		} else if directoryBlocks[block] {
+			for _, i := range indexes {
+				release(i, block, "in the directory")
+			}
+		} else if len(indexes) > 1 {
+			// the most plausible owner keeps the block, the first one on a tie
+			keeper := indexes[0]
+			for _, i := range indexes[1:] {
+				if original[i].problemCount(dpb) < original[keeper].problemCount(dpb) {
+					keeper = i
+				}
+			}
+
+			for _, i := range indexes {
+				if i != keeper {
+					release(i, block, "kept by "+entryName(keeper))
+				}
+			}
+		}
+	}
+
+	if err != nil {
+		return repaired, changes, err
+	}
+
+	// number the entries of each file from zero, in their present order
+	for _, filename := range filenames {
+		indexes := files[filename]
+		sort.SliceStable(indexes, func(a, b int) bool {
+			return original[indexes[a]].entryNumber(dpb) < original[indexes[b]].entryNumber(dpb)
+		})
+
+		for number, i := range indexes {
+			oldExtent := int(entries[i].S2)*32 + int(entries[i].Extent)
+			newExtent := number*(dpb.EXM+1) + oldExtent&dpb.EXM
+
+			if newExtent != oldExtent {
+				entries[i].Extent = byte(newExtent % 32)
+				entries[i].S2 = byte(newExtent / 32)
+				changes = append(changes, fmt.Sprintf("%s: extent %d -> %d", filename, original[i].entryNumber(dpb), number))
+			}
+		}
+	}
+
+	for i, entry := range entries {
+		if entry != original[i] {
+			err = volume.writeEntry(i, entry)
+			if err != nil {
+				return repaired, changes, err
+			}
+		}
+	}
+
+	return repaired, changes, nil
+}
+
+// write a repaired copy of the volume to a new host file
+func repairCommand(volume Volume, parts []string) {
+	var err error
+
+	if len(parts) < 2 {
+		err = errors.New("File name required")
+	}
+
+	if err == nil {
+		repaired, changes, repairErr := Repair(volume.data, volume.dpb)
+		err = repairErr
+
+		if err == nil {
+			err = utils.SaveRepair(parts[1], repaired, changes)
+		}
+	}
+
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+
+	fmt.Println()
+}
@@ -0,0 +1,303 @@
+/*
+Package cpm of H-8/H-89 disk reader
+*/
+package cpm
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/jfitz/h8d-examiner/utils"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileDetails is the CP/M information for a file, in FileEntry.Sys
+type FileDetails struct {
+	User      int
+	Flags     []bool // R/O, SYS, archive (high bits of extension)
+	NameFlags []bool // F1-F8 (high bits of name)
+	Extents   int
+	Records   int
+}
+
+func (details FileDetails) flagsToText() string {
+	// flags come from extent 0 only
+	if details.Flags == nil {
+		return ""
+	}
+
+	return flagsToText(details.Flags) + specialFlagsToText(details.NameFlags)
+}
+
+// Volume is a CP/M file system in a disk image
+type Volume struct {
+	data      []byte
+	directory []byte
+	dpb       DiskParameterBlock
+	user      int // default user area for file names without one
+}
+
+func (volume *Volume) Init(data []byte, dpb DiskParameterBlock) error {
+	// a format chosen with -format may need more blocks than the image has
+	if len(data) < dpb.imageSize() {
+		return utils.ImageSizeError{Format: dpb.Name, Size: len(data), FormatSize: dpb.imageSize()}
+	}
+
+	directory, err := readDirectory(data, dpb)
+	if err != nil {
+		return err
+	}
+
+	volume.data = data
+	volume.dpb = dpb
+	volume.directory = directory
+
+	return nil
+}
+
+func (volume Volume) directoryEntries() []DirectoryEntry {
+	entries := []DirectoryEntry{}
+
+	index := 0
+	entrySize := 32
+
+	for index < len(volume.directory) {
+		end := index + entrySize
+		entry := DirectoryEntry{}
+		entry.Init(volume.directory[index:end])
+		entries = append(entries, entry)
+
+		index += entrySize
+	}
+
+	return entries
+}
+
+// one FileEntry per file (not per extent), ordered by user
+func (volume Volume) Entries() ([]utils.FileEntry, error) {
+	entries := volume.directoryEntries()
+	fileEntries := []utils.FileEntry{}
+
+	// list every file, and report the first problem
+	var err error
+
+	// for each user (0 to 31)
+	for user := 0; user < 32; user++ {
+		// get list of all file names with no repeats (strip flags)
+		fileNames := []string{}
+		fileDetails := map[string]FileDetails{}
+
+		for _, entry := range entries {
+			if int(entry.User) == user {
+				// get filename
+				filename := entry.nameToText()
+
+				details, ok := fileDetails[filename]
+				if !ok {
+					fileNames = append(fileNames, filename)
+					details.User = user
+				}
+
+				// the first entry holds logical extents 0 to EXM
+				if int(entry.Extent)&^volume.dpb.EXM == 0 && entry.S2 == 0 {
+					// extract flags from extension and name
+					details.Flags = getHighBit(entry.Extension[:])
+					details.NameFlags = getHighBit(entry.Name[:])
+				}
+
+				// calculate size
+				blocks := entry.usedBlocks(volume.dpb)
+				recordCount := entry.recordCount(volume.dpb)
+				recordNumbers, entryErr := allRecords(blocks, recordCount, volume.dpb)
+				if err == nil {
+					err = entryErr
+				}
+
+				details.Records += len(recordNumbers)
+				details.Extents += 1
+
+				fileDetails[filename] = details
+			}
+		}
+
+		for _, filename := range fileNames {
+			details := fileDetails[filename]
+			fileEntry := utils.FileEntry{
+				Name:    volume.fileSpec(user, filename),
+				Size:    int64(details.Records) * 128,
+				ModTime: time.Time{},
+				Sys:     details,
+			}
+
+			fileEntries = append(fileEntries, fileEntry)
+		}
+	}
+
+	return fileEntries, err
+}
+
+// files outside the default user area are named U:NAME.EXT
+func (volume Volume) fileSpec(user int, filename string) string {
+	if user == volume.user {
+		return filename
+	}
+
+	return fmt.Sprintf("%d:%s", user, filename)
+}
+
+func (volume Volume) Stat(filename string) (utils.FileEntry, error) {
+	user, name, extension, err := splitFilename(filename, volume.user)
+	if err != nil {
+		return utils.FileEntry{}, err
+	}
+
+	fileEntries, err := volume.Entries()
+
+	for _, fileEntry := range fileEntries {
+		details := fileEntry.Sys.(FileDetails)
+		if details.User == user && fileEntry.Name == volume.fileSpec(user, name+"."+extension) {
+			return fileEntry, nil
+		}
+	}
+
+	if err != nil {
+		return utils.FileEntry{}, err
+	}
+
+	return utils.FileEntry{}, utils.ErrFileNotFound
+}
+
+// record numbers of a file, in order
+func (volume Volume) recordNumbers(filename string) ([]int, error) {
+	user, name, extension, err := splitFilename(filename, volume.user)
+	if err != nil {
+		return []int{}, err
+	}
+
+	return getRecordNumbers(volume.data, volume.directory, user, name, extension, volume.dpb)
+}
+
+func (volume Volume) readFile(filename string) ([]byte, error) {
+	contents := []byte{}
+
+	recordNumbers, err := volume.recordNumbers(filename)
+	if err != nil {
+		return contents, err
+	}
+
+	// for each record in file
+	for _, record := range recordNumbers {
+		recordBytes, err := readRecord(volume.data, record)
+		if err != nil {
+			return contents, err
+		}
+
+		contents = append(contents, recordBytes...)
+	}
+
+	return contents, nil
+}
+
+func (volume Volume) Open(filename string) (io.ReadSeeker, error) {
+	contents, err := volume.readFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(contents), nil
+}
+
+func (volume Volume) FreeSpace() (int64, error) {
+	blockSize := volume.dpb.blockSize()
+
+	// the directory occupies the first blocks
+	usedBlocks := map[int]bool{}
+	for _, block := range volume.dpb.directoryBlocks() {
+		usedBlocks[block] = true
+	}
+
+	for _, entry := range volume.directoryEntries() {
+		if entry.User < 32 {
+			for _, block := range entry.allocationBlocks(volume.dpb) {
+				usedBlocks[block] = true
+			}
+		}
+	}
+
+	freeBlocks := volume.dpb.blockCount() - len(usedBlocks)
+	if freeBlocks < 0 {
+		freeBlocks = 0
+	}
+
+	return int64(freeBlocks) * int64(blockSize), nil
+}
+
+// allocated blocks of a file, for all extents in order
+func (volume Volume) fileBlocks(user int, filename string) []int {
+	entries := []DirectoryEntry{}
+
+	for _, entry := range volume.directoryEntries() {
+		if int(entry.User) == user && entry.nameToText() == filename {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].S2 != entries[j].S2 {
+			return entries[i].S2 < entries[j].S2
+		}
+
+		return entries[i].Extent < entries[j].Extent
+	})
+
+	blocks := []int{}
+	for _, entry := range entries {
+		blocks = append(blocks, entry.allocationBlocks(volume.dpb)...)
+	}
+
+	return blocks
+}
+
+// FileMetadata is what CP/M records about a file, for export
+type FileMetadata struct {
+	Name       string
+	User       int
+	Size       int64
+	Attributes string // W (read-only), S (system), A (archived), 1-8 (F1-F8)
+	Extents    int
+	Records    int
+	Blocks     []int
+}
+
+func (volume Volume) Describe(filename string) (interface{}, error) {
+	fileEntry, err := volume.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	details := fileEntry.Sys.(FileDetails)
+	name := bareFilename(fileEntry.Name)
+
+	metadata := FileMetadata{
+		Name:       name,
+		User:       details.User,
+		Size:       fileEntry.Size,
+		Attributes: strings.Replace(details.flagsToText(), " ", "", -1),
+		Extents:    details.Extents,
+		Records:    details.Records,
+		Blocks:     volume.fileBlocks(details.User, name),
+	}
+
+	return metadata, nil
+}
+
+// FS returns the volume as an io/fs file system
+func (volume Volume) FS() fs.FS {
+	fsys := utils.FS{}
+	fsys.Init(volume)
+
+	return fsys
+}
@@ -0,0 +1,73 @@
+/*
+Package detect of H-8/H-89 disk reader
+*/
+package detect
+
+import (
+	"fmt"
+	"github.com/jfitz/h8d-examiner/cpm"
+	"github.com/jfitz/h8d-examiner/hdos"
+)
+
+type Format int
+
+const (
+	Unknown Format = iota
+	HDOS
+	CPM
+)
+
+func (format Format) String() string {
+	if format == HDOS {
+		return "HDOS"
+	}
+
+	if format == CPM {
+		return "CP/M"
+	}
+
+	return "unknown"
+}
+
+// minimum score to accept a format
+const threshold = 0.6
+
+type Result struct {
+	Format     Format
+	Confidence float64
+	HdosScore  float64
+	CpmScore   float64
+}
+
+func (result Result) Print() {
+	fmt.Printf("Format: %s (confidence %.2f)\n", result.Format, result.Confidence)
+	fmt.Printf("HDOS score: %.2f\n", result.HdosScore)
+	fmt.Printf("CP/M score: %.2f\n", result.CpmScore)
+}
+
+// Detect scores the image as each known format and picks the most likely
+func Detect(data []byte, dpb cpm.DiskParameterBlock) Result {
+	result := Result{}
+
+	result.HdosScore = hdos.Score(data)
+	result.CpmScore = cpm.Score(data, dpb)
+
+	best := result.HdosScore
+	other := result.CpmScore
+	result.Format = HDOS
+
+	if result.CpmScore > result.HdosScore {
+		best = result.CpmScore
+		other = result.HdosScore
+		result.Format = CPM
+	}
+
+	if best < threshold {
+		result.Format = Unknown
+	}
+
+	// confidence is the margin over the runner-up
+	result.Confidence = best - other
+
+	return result
+}
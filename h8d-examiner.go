@@ -5,51 +5,223 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
 	"github.com/jfitz/h8d-examiner/cpm"
+	"github.com/jfitz/h8d-examiner/detect"
 	"github.com/jfitz/h8d-examiner/hdos"
+	"github.com/jfitz/h8d-examiner/imd"
+	"github.com/jfitz/h8d-examiner/pack"
 	"github.com/jfitz/h8d-examiner/sector"
 	"github.com/jfitz/h8d-examiner/utils"
+	"io"
 	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 )
 
 func mainHelp() {
 	fmt.Println("stats - display statistics")
+	fmt.Println("detect - guess the disk format")
 	fmt.Println("hdos  - interpret as HDOS disk")
 	fmt.Println("cp/m  - interpret as CP/M disk")
 	fmt.Println("RESETTERM - reset VT-100 terminal")
 	fmt.Println("quit  - exit the program")
 }
 
+// end of input stops the program, other errors only stop the menu
+func checkMenuError(err error) {
+	if err == io.EOF {
+		utils.CheckAndExit(err)
+	}
+
+	if err != nil {
+		fmt.Println(err.Error())
+		fmt.Println()
+	}
+}
+
+// write the image back to its file
+func saveImage(fileName string, data []byte) error {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+
+	// the decoded sectors would replace the IMD file
+	fh, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+
+	signature := make([]byte, len(imd.Signature))
+	fh.Read(signature)
+	fh.Close()
+
+	if imd.IsIMD(signature) {
+		return utils.ErrReadOnlyImage
+	}
+
+	return ioutil.WriteFile(fileName, data, info.Mode())
+}
+
+// write the image if a menu changed it
+func saveChanges(fileName string, data []byte, original []byte) {
+	if bytes.Equal(data, original) {
+		return
+	}
+
+	err := saveImage(fileName, data)
+	if err == nil {
+		fmt.Printf("Saved %s\n", fileName)
+	} else {
+		fmt.Println(err.Error())
+	}
+
+	fmt.Println()
+}
+
+// write a blank HDOS or CP/M image to a new file
+// files from a pack source are written into it
+func createImage(fileName string, layoutName string, cpmDisk bool, formats []cpm.DiskParameterBlock, templateFile string, label string, serial int, date time.Time, packSource string) error {
+	data := []byte{}
+
+	files := []pack.File{}
+	if len(packSource) > 0 {
+		var err error
+		files, err = pack.ReadSource(packSource)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cpmDisk {
+		dpb, err := cpm.FindFormat(formats, layoutName)
+		if err != nil {
+			return err
+		}
+
+		template := []byte{}
+		if len(templateFile) > 0 {
+			template, err = ioutil.ReadFile(templateFile)
+			if err != nil {
+				return err
+			}
+		}
+
+		data, err = cpm.Format(dpb, template)
+		if err != nil {
+			return err
+		}
+
+		err = pack.CPM(data, files, dpb)
+		if err != nil {
+			return err
+		}
+	} else {
+		layout, err := hdos.FindLayout(layoutName)
+		if err != nil {
+			return err
+		}
+
+		options := hdos.FormatOptions{
+			Serial: byte(serial),
+			Label:  label,
+			Date:   date,
+		}
+
+		data, err = hdos.Format(layout, options)
+		if err != nil {
+			return err
+		}
+
+		err = pack.HDOS(data, files, date)
+		if err != nil {
+			return err
+		}
+	}
+
+	// never replace an existing image
+	err := utils.WriteNewFile(fileName, data)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Created %s (%s)\n", fileName, layoutName)
+
+	return nil
+}
+
+// print the problems found by a check, and exit with status 1 if there are any
+func printProblems(problems []string) {
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+
+	if len(problems) == 0 {
+		fmt.Println("No problems found")
+	} else {
+		fmt.Printf("%d problem(s) found\n", len(problems))
+		os.Exit(1)
+	}
+}
+
 func main() {
 	exportDirectoryPtr := flag.String("directory", ".", "Export to directory")
 	exportSpecPtr := flag.String("export", "", "Export file specification")
+	metadataPtr := flag.String("metadata", "none", "Export metadata: none, sidecar, or manifest")
+	importFilePtr := flag.String("import", "", "Import file into disk image")
+	importNamePtr := flag.String("name", "", "Name of imported file in disk image")
+	importFlagsPtr := flag.String("flags", "", "Flags of imported file (HDOS: S, L, W, C; CP/M: W, S, A)")
+	importProjectPtr := flag.Int("project", 0, "HDOS project of imported file")
+	importVersionPtr := flag.Int("version", 0, "HDOS version of imported file")
+	datePtr := flag.String("date", "", "Date of blank HDOS disk image and packed or imported files (DD-MMM-YYYY, default today)")
 	catSpecPtr := flag.Bool("cat", false, "List files in disk image")
+	checkDiskPtr := flag.Bool("check", false, "Check disk image for problems (exit status 1 if any)")
+	repairFilePtr := flag.String("repair", "", "Write a repaired copy of the disk image to a new file")
+	initLayoutPtr := flag.String("init", "", "Create a blank disk image with the HDOS layout (or CP/M format with -cpm)")
+	initTemplatePtr := flag.String("template", "", "Image to copy CP/M system tracks from")
+	initLabelPtr := flag.String("label", "", "Label of blank HDOS disk image")
+	initSerialPtr := flag.Int("serial", 0, "Serial number of blank HDOS disk image")
+	packSourcePtr := flag.String("pack", "", "Directory or manifest of files to write into the blank disk image")
 	hdosDiskPtr := flag.Bool("hdos", false, "Interpret as HDOS disk")
 	cpmDiskPtr := flag.Bool("cpm", false, "Interpret as CP/M disk")
+	h17DiskPtr := flag.Bool("h17", false, "H-17 hard-sector format")
 	h37DiskPtr := flag.Bool("h37", false, "H-37 soft-sector format")
+	h47DiskPtr := flag.Bool("h47", false, "H-47 8-inch format")
+	formatPtr := flag.String("format", "", "CP/M format name")
+	formatFilePtr := flag.String("formatfile", "", "File of CP/M format definitions")
 
 	// parse command line options
 	flag.Parse()
 
 	exportDirectory := *exportDirectoryPtr
 	exportSpec := *exportSpecPtr
+	metadataMode, err := utils.ParseMetadataMode(*metadataPtr)
+	utils.CheckAndExit(err)
+	importFile := *importFilePtr
+	importName := *importNamePtr
+	importFlags := *importFlagsPtr
+	importProject := *importProjectPtr
+	importVersion := *importVersionPtr
+	dateText := *datePtr
 	catSpec := *catSpecPtr
+	checkDisk := *checkDiskPtr
+	repairFile := *repairFilePtr
+	initLayout := *initLayoutPtr
+	initTemplate := *initTemplatePtr
+	initLabel := *initLabelPtr
+	initSerial := *initSerialPtr
+	packSource := *packSourcePtr
 	hdosDisk := *hdosDiskPtr
 	cpmDisk := *cpmDiskPtr
+	h17Disk := *h17DiskPtr
 	h37Disk := *h37DiskPtr
-
-	diskType := utils.H17
-
-	if h37Disk {
-		diskType = utils.H37
-	}
-
-	sides := utils.SingleSided
-	diskGeometry := utils.DiskGeometry{sides, 40, 10, 256, 10}
+	h47Disk := *h47DiskPtr
+	formatName := *formatPtr
+	formatFile := *formatFilePtr
 
 	args := flag.Args()
 
@@ -61,6 +233,35 @@ func main() {
 	// get file name
 	fileName := args[0]
 
+	// CP/M formats, user definitions first
+	formats := []cpm.DiskParameterBlock{}
+
+	if len(formatFile) > 0 {
+		formats, err = cpm.ReadFormats(formatFile)
+		utils.CheckAndExit(err)
+	}
+
+	formats = append(formats, cpm.Formats...)
+
+	if len(packSource) > 0 && len(initLayout) == 0 {
+		fmt.Println("Specify the layout or CP/M format of the packed image with INIT")
+		os.Exit(1)
+	}
+
+	// a new image is written and nothing else is done
+	if len(initLayout) > 0 {
+		date := time.Now()
+		if len(dateText) > 0 {
+			date, err = hdos.TextToDate(dateText)
+			utils.CheckAndExit(err)
+		}
+
+		err = createImage(fileName, initLayout, cpmDisk, formats, initTemplate, initLabel, initSerial, date, packSource)
+		utils.CheckAndExit(err)
+
+		os.Exit(0)
+	}
+
 	reader := bufio.NewReader(os.Stdin)
 
 	// open the file
@@ -72,8 +273,49 @@ func main() {
 
 	fh.Close()
 
+	// IMD files are decoded to sectors in sector number order
+	imdSectors := []imd.Sector{}
+
+	if imd.IsIMD(data) {
+		image, err := imd.Decode(data)
+		utils.CheckAndExit(err)
+
+		data, imdSectors = image.Linear()
+	}
+
 	disk := utils.Disk{}
-	disk.Init(data)
+	err = disk.Init(data)
+	utils.CheckAndExit(err)
+
+	offset := 0
+	for _, sector := range imdSectors {
+		if !sector.Good() {
+			disk.SetStatus(offset, sector.Size, sector.Status())
+		}
+
+		offset += sector.Size
+	}
+
+	// CP/M format, from the options or from the disk
+	if len(formatName) > 0 {
+		dpb, err := cpm.FindFormat(formats, formatName)
+		utils.CheckAndExit(err)
+
+		formats = []cpm.DiskParameterBlock{dpb}
+	} else if h17Disk || h37Disk || h47Disk {
+		selected := []cpm.DiskParameterBlock{}
+
+		for _, dpb := range formats {
+			if (h17Disk && dpb.DiskType == utils.H17) || (h37Disk && dpb.DiskType == utils.H37) || (h47Disk && dpb.DiskType == utils.H47) {
+				selected = append(selected, dpb)
+			}
+		}
+
+		formats = selected
+	}
+
+	layout := cpm.DetectLayout(data, formats)
+	dpb := layout.Format
 
 	// get file statistics
 	fileSize := len(data)
@@ -81,35 +323,128 @@ func main() {
 	fileSectorCount := fileSize / 256
 	fileLastSector := fileSectorCount - 1
 
-	if len(exportSpec) > 0 || catSpec {
+	// batch commands
+	commandCount := 0
+
+	for _, given := range []bool{len(exportSpec) > 0, catSpec, len(importFile) > 0, checkDisk, len(repairFile) > 0} {
+		if given {
+			commandCount += 1
+		}
+	}
+
+	if commandCount > 0 {
 		// batch mode - run command and exit
 
-		if len(exportSpec) > 0 && catSpec {
-			fmt.Println("Specify only one of EXPORT or CAT")
+		// without a format option, look at the disk to choose one
+		if !hdosDisk && !cpmDisk {
+			result := detect.Detect(data, dpb)
+			hdosDisk = result.Format == detect.HDOS
+			cpmDisk = result.Format == detect.CPM
+		}
+
+		if commandCount > 1 {
+			fmt.Println("Specify only one of EXPORT, CAT, IMPORT, CHECK or REPAIR")
 		} else if len(exportSpec) > 0 {
 			// export the specified file(s)
 			if hdosDisk && cpmDisk {
 				fmt.Println("Specify only one of HDOS and CP/M")
 			} else if hdosDisk {
-				hdos.Export(data, exportSpec, exportDirectory)
+				err = hdos.Export(data, exportSpec, exportDirectory, metadataMode)
+				utils.CheckAndExit(err)
 			} else if cpmDisk {
-				cpm.Export(data, exportSpec, exportDirectory, diskGeometry, diskType)
+				err = cpm.Export(data, exportSpec, exportDirectory, metadataMode, dpb)
+				utils.CheckAndExit(err)
 			} else {
-				fmt.Println("Must specify either HDOS or CP/M")
+				fmt.Println("Cannot determine disk format, specify either HDOS or CP/M")
+				os.Exit(1)
 			}
 		} else if catSpec {
 			// list the specified file(s)
 			if hdosDisk && cpmDisk {
 				fmt.Println("Specify only one of HDOS and CP/M")
 			} else if hdosDisk {
-				hdos.Cat(data)
+				err = hdos.Cat(data)
+				utils.CheckAndExit(err)
+			} else if cpmDisk {
+				err = cpm.Cat(data, dpb)
+				utils.CheckAndExit(err)
+			} else {
+				fmt.Println("Cannot determine disk format, specify either HDOS or CP/M")
+				os.Exit(1)
+			}
+		} else if len(importFile) > 0 {
+			// copy a host file into the image
+			if hdosDisk && cpmDisk {
+				fmt.Println("Specify only one of HDOS and CP/M")
+			} else if hdosDisk {
+				flags, err := hdos.TextToFlags(importFlags)
+				utils.CheckAndExit(err)
+
+				date := time.Now()
+				if len(dateText) > 0 {
+					date, err = hdos.TextToDate(dateText)
+					utils.CheckAndExit(err)
+				}
+
+				options := hdos.ImportOptions{
+					Name:    importName,
+					Flags:   flags,
+					Project: byte(importProject),
+					Version: byte(importVersion),
+					Date:    date,
+				}
+
+				err = hdos.Import(data, importFile, options)
+				utils.CheckAndExit(err)
+
+				err = saveImage(fileName, data)
+				utils.CheckAndExit(err)
 			} else if cpmDisk {
-				cpm.Cat(data, diskGeometry, diskType)
+				options := cpm.ImportOptions{Name: importName}
+				err = cpm.TextToFlags(importFlags, &options)
+				utils.CheckAndExit(err)
+
+				err = cpm.Import(data, importFile, options, dpb)
+				utils.CheckAndExit(err)
+
+				err = saveImage(fileName, data)
+				utils.CheckAndExit(err)
 			} else {
-				fmt.Println("Must specify either HDOS or CP/M")
+				fmt.Println("Cannot determine disk format, specify either HDOS or CP/M")
+				os.Exit(1)
+			}
+		} else if checkDisk {
+			// report problems, and fail if there are any
+			if hdosDisk && cpmDisk {
+				fmt.Println("Specify only one of HDOS and CP/M")
+			} else if hdosDisk {
+				printProblems(hdos.Check(data))
+			} else if cpmDisk {
+				printProblems(cpm.Check(data, dpb))
+			} else {
+				fmt.Println("Cannot determine disk format, specify either HDOS or CP/M")
+				os.Exit(1)
+			}
+		} else if len(repairFile) > 0 {
+			// the original image is never changed
+			if hdosDisk && cpmDisk {
+				fmt.Println("Specify only one of HDOS and CP/M")
+			} else if hdosDisk {
+				repaired, changes, err := hdos.Repair(data)
+				utils.CheckAndExit(err)
+
+				err = utils.SaveRepair(repairFile, repaired, changes)
+				utils.CheckAndExit(err)
+			} else if cpmDisk {
+				repaired, changes, err := cpm.Repair(data, dpb)
+				utils.CheckAndExit(err)
+
+				err = utils.SaveRepair(repairFile, repaired, changes)
+				utils.CheckAndExit(err)
+			} else {
+				fmt.Println("Cannot determine disk format, specify either HDOS or CP/M")
+				os.Exit(1)
 			}
-		} else {
-			fmt.Println("Must specify export specification or cat specification")
 		}
 	} else {
 		// prompt for command and process it
@@ -133,15 +468,26 @@ func main() {
 				fmt.Printf("Size: %d (%dK)\n", fileSize, fileSizeInK)
 				fmt.Printf("Last sector: %04XH (%d)\n", fileLastSector, fileLastSector)
 				fmt.Println()
+			} else if line == "detect" {
+				result := detect.Detect(data, dpb)
+				result.Print()
+				fmt.Println()
 			} else if line == "sector" {
 				fmt.Println()
-				sector.Menu(reader, data)
+				err = sector.Menu(reader, disk)
+				checkMenuError(err)
 			} else if line == "hdos" {
 				fmt.Println()
-				hdos.Menu(reader, data, exportDirectory)
+				original := append([]byte{}, data...)
+				err = hdos.Menu(reader, data, exportDirectory, metadataMode)
+				saveChanges(fileName, data, original)
+				checkMenuError(err)
 			} else if line == "cp/m" {
 				fmt.Println()
-				cpm.Menu(reader, data, exportDirectory, diskGeometry, diskType)
+				original := append([]byte{}, data...)
+				err = cpm.Menu(reader, data, exportDirectory, metadataMode, dpb)
+				saveChanges(fileName, data, original)
+				checkMenuError(err)
 			} else if line == "RESETTERM" {
 				fmt.Println("\x1bc")
 			} else {
@@ -0,0 +1,230 @@
+/*
+Package hdos of H-8/H-89 disk reader
+*/
+package hdos
+
+import (
+	"fmt"
+	"github.com/jfitz/h8d-examiner/utils"
+)
+
+// problems found while checking a volume
+type checker struct {
+	problems []string
+}
+
+func (c *checker) report(format string, args ...interface{}) {
+	c.problems = append(c.problems, fmt.Sprintf(format, args...))
+}
+
+// the number of sectors must agree with the volume flags (40/80 tracks, 1/2 sides)
+func (c *checker) checkLabel(label Label, sectorCount int) {
+	if label.Spg != 1 && label.Spg != 2 && label.Spg != 4 && label.Spg != 8 {
+		c.report("Label: sectors per group is %d, not 1, 2, 4 or 8", label.Spg)
+	}
+
+	if label.Siz > sectorCount {
+		c.report("Label: %d sectors, but the image has %d", label.Siz, sectorCount)
+	}
+
+	if label.Dir < 10 || label.Dir+1 >= label.Siz {
+		c.report("Label: directory sector %d is not on the disk", label.Dir)
+	}
+
+	if label.Grt < 10 || label.Grt >= label.Siz {
+		c.report("Label: GRT sector %d is not on the disk", label.Grt)
+	}
+
+	// older volumes have no flags or size
+	if label.Ver < 0x20 {
+		return
+	}
+
+	sides := 1 + label.Flags&1
+	tracks := 40
+	if label.Flags&2 == 2 {
+		tracks = 80
+	}
+
+	// 80 track volumes may be larger (102, 160 and 204 track drives)
+	size := sides * tracks * sectorsPerTrack
+	if label.Flags > 3 || (tracks == 40 && label.Siz != size) || (tracks == 80 && label.Siz < size) {
+		c.report("Label: %d sectors does not match flags 0x%02X (%d side(s), %d tracks)", label.Siz, label.Flags, sides, tracks)
+	}
+}
+
+// walk the directory chain, reporting loops and links off the disk
+func (c *checker) checkDirectory(volume Volume) []DirectoryEntry {
+	entries := []DirectoryEntry{}
+
+	slots, err := volume.directorySlots()
+
+	// a block with a bad link is probably not a directory block, so skip its entries
+	badSector := -1
+	if linkErr, ok := err.(utils.DirectoryLinkError); ok {
+		badSector = linkErr.Sector
+		c.report("Directory: %s (entries in that block not checked)", err.Error())
+	} else if err != nil {
+		c.report("Directory: %s", err.Error())
+	}
+
+	for _, slot := range slots {
+		sector := slot / 256
+		if sector == badSector || sector == badSector+1 {
+			continue
+		}
+
+		entry := DirectoryEntry{}
+		entry.Init(volume.data[slot : slot+23])
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// file name for the report, quoted if it is not printable
+func reportName(entry DirectoryEntry) string {
+	name := entry.filename()
+
+	if printableFraction(name) < 1.0 {
+		return fmt.Sprintf("%q", name)
+	}
+
+	return name
+}
+
+// follow a chain of groups; stop at a loop or a group off the disk
+func (c *checker) walkChain(grt []byte, first int, groupCount int, name string) []int {
+	groups := []int{}
+	seen := map[int]bool{}
+
+	for index := first; index != 0; index = int(grt[index]) {
+		if index >= groupCount {
+			c.report("%s: group %d is past the end of the disk (%d groups)", name, index, groupCount)
+			return groups
+		}
+
+		if seen[index] {
+			c.report("%s: chain loops at group %d", name, index)
+			return groups
+		}
+
+		seen[index] = true
+		groups = append(groups, index)
+	}
+
+	return groups
+}
+
+func (c *checker) checkFile(entry DirectoryEntry, volume Volume, groupCount int) []int {
+	name := reportName(entry)
+
+	if entry.FirstCluster == 0 {
+		c.report("%s: first group is 0", name)
+		return []int{}
+	}
+
+	groups := c.walkChain(volume.grt, int(entry.FirstCluster), groupCount, name)
+
+	// INIT.ABS 1.6 sometimes leaves the last group of DIRECT.SYS as 0
+	quirk := name == "DIRECT.SYS" && entry.LastCluster == 0
+
+	if len(groups) > 0 && groups[len(groups)-1] != int(entry.LastCluster) && !quirk {
+		c.report("%s: last group is %d, but the chain ends at %d", name, entry.LastCluster, groups[len(groups)-1])
+	}
+
+	if int(entry.LastSector) > volume.label.Spg || entry.LastSector == 0 {
+		c.report("%s: last sector %d is not in 1 to %d", name, entry.LastSector, volume.label.Spg)
+	}
+
+	return groups
+}
+
+// Check validates the label, directory chain and GRT, and returns the problems found
+func Check(data []byte) []string {
+	c := checker{}
+
+	volume := Volume{}
+	err := volume.Init(data)
+	if err != nil {
+		c.report("Label: %s", err.Error())
+		return c.problems
+	}
+
+	label := volume.label
+	c.checkLabel(label, len(data)/256)
+
+	if label.Spg == 0 {
+		return c.problems
+	}
+
+	groupCount := label.Siz / label.Spg
+	if groupCount > len(volume.grt) {
+		groupCount = len(volume.grt)
+	}
+
+	entries := c.checkDirectory(volume)
+
+	// which file owns each group
+	owners := map[int]string{}
+
+	for _, entry := range entries {
+		if !entry.inUse() {
+			continue
+		}
+
+		name := reportName(entry)
+		for _, group := range c.checkFile(entry, volume, groupCount) {
+			owner, ok := owners[group]
+			if ok {
+				c.report("Group %d is used by %s and %s", group, owner, name)
+			} else {
+				owners[group] = name
+			}
+		}
+	}
+
+	// free chain starts at group 0
+	free := map[int]bool{}
+	for _, group := range c.walkChain(volume.grt, int(volume.grt[0]), groupCount, "Free chain") {
+		owner, ok := owners[group]
+		if ok {
+			c.report("Group %d is free but used by %s", group, owner)
+		}
+
+		free[group] = true
+	}
+
+	// boot sectors and the label (sector 9) are reserved, as are groups marked 0xFF
+	firstGroup := (10 + label.Spg - 1) / label.Spg
+
+	lost := []int{}
+	for group := firstGroup; group < groupCount; group++ {
+		_, owned := owners[group]
+		if !owned && !free[group] && volume.grt[group] != 0xff {
+			lost = append(lost, group)
+		}
+	}
+
+	if len(lost) > 0 {
+		c.report("Groups neither free nor used: %v", lost)
+	}
+
+	return c.problems
+}
+
+func checkCommand(data []byte) {
+	problems := Check(data)
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+
+	if len(problems) == 0 {
+		fmt.Println("No problems found")
+	} else {
+		fmt.Printf("%d problem(s) found\n", len(problems))
+	}
+
+	fmt.Println()
+}
@@ -0,0 +1,81 @@
+/*
+Package hdos of H-8/H-89 disk reader
+*/
+package hdos
+
+// INIT.ABS versions seen on real disks
+var knownVersions = map[int]bool{0x00: true, 0x15: true, 0x16: true, 0x20: true, 0x22: true}
+
+// Score rates how much an image looks like an HDOS volume, from 0.0 to 1.0
+func Score(data []byte) float64 {
+	label, err := readLabel(data)
+	if err != nil {
+		return 0.0
+	}
+
+	sectorCount := len(data) / 256
+	points := 0
+	maxPoints := 0
+
+	// first directory sector is after the label and on the disk
+	maxPoints += 2
+	if label.Dir >= 10 && label.Dir+1 < sectorCount {
+		points += 2
+	}
+
+	// GRT sector is after the label and on the disk
+	maxPoints += 2
+	if label.Grt >= 10 && label.Grt < sectorCount {
+		points += 2
+	}
+
+	// sectors per group in 1,2,4,8
+	maxPoints += 2
+	if label.Spg == 1 || label.Spg == 2 || label.Spg == 4 || label.Spg == 8 {
+		points += 2
+	}
+
+	// known INIT.ABS version
+	maxPoints += 1
+	if knownVersions[label.Ver] {
+		points += 1
+	}
+
+	// number of sectors fits the image
+	maxPoints += 1
+	if label.Siz > 0 && label.Siz <= sectorCount {
+		points += 1
+	}
+
+	// label text is printable (not always true for real disks)
+	maxPoints += 1
+	if len(label.Text) > 0 && printableFraction(label.Text) > 0.9 {
+		points += 1
+	}
+
+	// directory chain can be walked
+	maxPoints += 3
+	volume := Volume{}
+	err = volume.Init(data)
+	if err == nil {
+		_, err = volume.directoryEntries()
+		if err == nil {
+			points += 3
+		}
+	}
+
+	return float64(points) / float64(maxPoints)
+}
+
+func printableFraction(text string) float64 {
+	printable := 0
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if c >= 32 && c <= 126 {
+			printable += 1
+		}
+	}
+
+	return float64(printable) / float64(len(text))
+}
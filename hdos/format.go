@@ -0,0 +1,307 @@
+/*
+Package hdos of H-8/H-89 disk reader
+*/
+package hdos
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Layout is the size and label values of a blank HDOS volume
+type Layout struct {
+	Name    string
+	Sides   int
+	Tracks  int // tracks per side
+	Sectors int
+	Spg     int
+	Flags   int
+	Ver     int
+}
+
+// layouts of the disks made by INIT.ABS (see test/EmptyHDOSImages)
+var Layouts = []Layout{
+	{Name: "1s40t", Sides: 1, Tracks: 40, Sectors: 400, Spg: 2, Flags: 0, Ver: 0x20},
+	{Name: "1s80t", Sides: 1, Tracks: 80, Sectors: 800, Spg: 4, Flags: 2, Ver: 0x20},
+	{Name: "2s40t", Sides: 2, Tracks: 40, Sectors: 800, Spg: 4, Flags: 1, Ver: 0x20},
+	{Name: "2s80t", Sides: 2, Tracks: 80, Sectors: 1600, Spg: 8, Flags: 3, Ver: 0x20},
+	{Name: "1s102t", Sides: 1, Tracks: 102, Sectors: 1020, Spg: 4, Flags: 2, Ver: 0x22},
+	{Name: "1s160t", Sides: 1, Tracks: 160, Sectors: 1600, Spg: 8, Flags: 2, Ver: 0x22},
+	{Name: "1s204t", Sides: 1, Tracks: 204, Sectors: 2040, Spg: 8, Flags: 2, Ver: 0x22},
+	{Name: "2s102t", Sides: 2, Tracks: 102, Sectors: 2040, Spg: 8, Flags: 3, Ver: 0x22},
+}
+
+const sectorsPerTrack = 10
+
+// INIT.ABS puts the directory at group 66, near the middle of a 40 track disk,
+// in an area of groups starting at 65
+const directoryGroup = 66
+const directoryArea = 65
+
+// FindLayout returns the layout with the given name
+func FindLayout(name string) (Layout, error) {
+	names := []string{}
+
+	for _, layout := range Layouts {
+		if layout.Name == name {
+			return layout, nil
+		}
+
+		names = append(names, layout.Name)
+	}
+
+	return Layout{}, errors.New("Unknown HDOS layout " + name + " (use " + strings.Join(names, ", ") + ")")
+}
+
+// ImageSize is the size of the disk image in bytes
+func (layout Layout) ImageSize() int {
+	return layout.Sectors * 256
+}
+
+// FormatOptions are the label fields chosen by the user
+type FormatOptions struct {
+	Serial byte
+	Label  string
+	Date   time.Time
+}
+
+func putWord(bs []byte, value int) {
+	bs[0] = byte(value % 256)
+	bs[1] = byte(value / 256)
+}
+
+// the start sectors of the directory groups, in the order INIT.ABS links them:
+// each group starts two sectors after the end of the one before, on the same track,
+// or on a later track when that group is taken (wrapping around the area)
+func directoryChain(spg int, groupCount int) []int {
+	areaStart := directoryArea * spg
+	areaEnd := areaStart + groupCount*spg
+
+	chain := []int{directoryGroup * spg}
+	used := map[int]bool{directoryGroup * spg: true}
+
+	for len(chain) < groupCount {
+		last := chain[len(chain)-1]
+		track := last / sectorsPerTrack * sectorsPerTrack
+		target := track + (last%sectorsPerTrack+spg+2)%sectorsPerTrack
+
+		// a group starts on a multiple of spg
+		next := -1
+		for tries := 0; tries < groupCount*sectorsPerTrack && next < 0; tries++ {
+			start := (target + spg - 1) / spg * spg
+			if start >= areaEnd {
+				start -= areaEnd - areaStart
+			}
+
+			if used[start] {
+				target = start + sectorsPerTrack
+			} else {
+				next = start
+			}
+		}
+
+		// no group at a later rotation, take the first one left
+		for start := areaStart; next < 0; start += spg {
+			if !used[start] {
+				next = start
+			}
+		}
+
+		chain = append(chain, next)
+		used[next] = true
+	}
+
+	return chain
+}
+
+// Format returns a blank HDOS volume with RGT.SYS, GRT.SYS and DIRECT.SYS,
+// with the structures INIT.ABS writes (see test/EmptyHDOSImages)
+func Format(layout Layout, options FormatOptions) ([]byte, error) {
+	if len(options.Label) > 60 {
+		return []byte{}, errors.New("Label is longer than 60 characters")
+	}
+
+	data := make([]byte, layout.ImageSize())
+
+	spg := layout.Spg
+	groupCount := layout.Sectors / spg
+
+	// boot sectors and the label (sector 9) come before the RGT
+	rgtGroup := (10 + spg - 1) / spg
+
+	// the groups of sectors 4 to 9 are reserved, any before them are in use
+	firstReserved := 4 / spg
+	if firstReserved == 0 {
+		firstReserved = 1
+	}
+
+	// 18 sectors of directory, in whole groups, and the GRT after it
+	directoryGroups := (18 + spg - 1) / spg
+	grtGroup := directoryArea + directoryGroups
+
+	chain := directoryChain(spg, directoryGroups)
+
+	dir := directoryGroup * spg
+	grt := grtGroup * spg
+	rgt := rgtGroup * spg
+
+	// label
+	date := encodeDate(options.Date)
+
+	label := data[9*256 : 10*256]
+	label[0] = options.Serial
+	copy(label[1:3], date[:])
+	putWord(label[3:5], dir)
+	putWord(label[5:7], grt)
+	label[7] = byte(spg)
+	label[8] = 0
+	label[9] = byte(layout.Ver)
+	putWord(label[10:12], rgt)
+	putWord(label[12:14], layout.Sectors)
+	putWord(label[14:16], 256)
+	label[16] = byte(layout.Flags)
+	copy(label[17:78], options.Label+strings.Repeat(" ", 61-len(options.Label)))
+	label[79] = sectorsPerTrack
+
+	// group tables: 0xFF is reserved or off the disk
+	grtBytes := data[grt*256 : grt*256+256]
+	rgtBytes := data[rgt*256 : rgt*256+256]
+
+	for group := 1; group < 256; group++ {
+		if group >= rgtGroup && group < groupCount {
+			rgtBytes[group] = 0x01
+		} else if group >= firstReserved {
+			grtBytes[group] = 0xff
+			rgtBytes[group] = 0xff
+		}
+	}
+
+	// system files
+	grtBytes[rgtGroup] = 0
+	grtBytes[grtGroup] = 0
+
+	for i, start := range chain {
+		next := 0
+		if i < len(chain)-1 {
+			next = chain[i+1] / spg
+		}
+
+		grtBytes[start/spg] = byte(next)
+	}
+
+	// every other group is free, in order
+	used := func(group int) bool {
+		return group == rgtGroup || group == grtGroup || (group >= directoryArea && group < grtGroup)
+	}
+
+	last := 0
+	for group := rgtGroup; group < groupCount; group++ {
+		if !used(group) {
+			grtBytes[last] = byte(group)
+			last = group
+		}
+	}
+	grtBytes[last] = 0
+
+	// directory blocks, in chain order
+	blocks := []int{}
+	for _, start := range chain {
+		for sector := start; sector < start+spg; sector += 2 {
+			blocks = append(blocks, sector)
+		}
+	}
+
+	// the first 6 sectors (in whole groups) have empty slots (0xFF), the rest
+	// end the directory (0xFE); the system files are in slots 18 to 20 of the
+	// block that ends the first 8 sectors (or the first two groups)
+	emptyBlocks := (6 + spg - 1) / spg * spg / 2
+	entrySectors := 8
+	if 2*spg < entrySectors {
+		entrySectors = 2 * spg
+	}
+	entryBlock := entrySectors/2 - 1
+
+	for i, sector := range blocks {
+		block := data[sector*256 : sector*256+512]
+
+		marker := byte(0xfe)
+		if i < emptyBlocks {
+			marker = 0xff
+		}
+
+		for slot := 0; slot < 22; slot++ {
+			block[slot*23] = marker
+		}
+
+		next := 0
+		if i < len(blocks)-1 {
+			next = blocks[i+1]
+		}
+
+		block[507] = 23
+		putWord(block[508:510], sector)
+		putWord(block[510:512], next)
+	}
+
+	entries := []DirectoryEntry{
+		{FirstCluster: byte(rgtGroup), LastCluster: byte(rgtGroup), LastSector: 1, Flags: 0360},
+		{FirstCluster: byte(grtGroup), LastCluster: byte(grtGroup), LastSector: 1, Flags: 0360},
+		{FirstCluster: byte(chain[0] / spg), LastCluster: byte(chain[len(chain)-1] / spg), LastSector: byte(spg), Flags: 0340},
+	}
+
+	for i, name := range systemFiles {
+		entry := entries[i]
+		entry.Name, entry.Extension, _ = nameToFields(name)
+		entry.CreateDate = date
+		entry.ModifyDate = date
+
+		slot := blocks[entryBlock]*256 + (18+i)*23
+		copy(data[slot:slot+23], entry.bytes())
+	}
+
+	// and the slot after them is marked as the end
+	data[blocks[entryBlock]*256+21*23] = 0xfe
+
+	return data, nil
+}
+
+// write a blank volume over an image of the same size
+func initCommand(data []byte, parts []string) error {
+	var err error
+
+	if len(parts) < 2 {
+		err = errors.New("Layout required")
+	}
+
+	layout := Layout{}
+	if err == nil {
+		layout, err = FindLayout(parts[1])
+	}
+
+	if err == nil && layout.ImageSize() != len(data) {
+		err = fmt.Errorf("Layout %s needs an image of %d bytes, not %d", layout.Name, layout.ImageSize(), len(data))
+	}
+
+	formatted := []byte{}
+	if err == nil {
+		options := FormatOptions{
+			Label: strings.Join(parts[2:], " "),
+			Date:  time.Now(),
+		}
+
+		formatted, err = Format(layout, options)
+	}
+
+	if err == nil {
+		copy(data, formatted)
+		fmt.Printf("Initialized %s volume\n", layout.Name)
+	} else {
+		fmt.Println(err.Error())
+	}
+
+	fmt.Println()
+
+	return err
+}
@@ -5,9 +5,10 @@ package hdos
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"github.com/jfitz/h8d-examiner/utils"
-	"os"
+	"io/ioutil"
 	"strings"
 )
 
@@ -17,33 +18,51 @@ func help() {
 	fmt.Println("dir    - same as CAT")
 	fmt.Println("type   - display contents of file")
 	fmt.Println("dump   - dump contents of file")
-	fmt.Println("export - copy file to your filesystem")
+	fmt.Println("export - copy file(s) to your filesystem (* and ? allowed)")
+	fmt.Println("import - copy file from your filesystem (import FILE [NAME.EXT [FLAGS]])")
+	fmt.Println("delete - remove file (delete NAME.EXT [force])")
+	fmt.Println("rename - change name of file (rename NAME.EXT NEW.EXT [force])")
+	fmt.Println("init   - write a blank volume (init LAYOUT [LABEL])")
+	fmt.Println("check  - check directory and GRT for problems (also fsck)")
+	fmt.Println("repair - write a repaired copy to your filesystem (repair FILE)")
+	fmt.Println("metadata - show or set export metadata (none, sidecar, manifest)")
 	fmt.Println("exit   - exit to main level")
 }
 
-func readSectorPair(data []byte, sectorIndex int) ([]byte) {
+func readSectorPair(data []byte, sectorIndex int) ([]byte, error) {
 	// read 2 sectors (512 bytes)
-	start1 := sectorIndex * 256
-	end1 := start1 + 256
-	first := data[start1:end1]
+	_, err := utils.GetSector(data, sectorIndex)
+	if err != nil {
+		return []byte{}, err
+	}
 
-	start2 := end1
-	end2 := start2 + 256
-	second := data[start2:end2]
+	_, err = utils.GetSector(data, sectorIndex+1)
+	if err != nil {
+		return []byte{}, err
+	}
 
-	directoryBlock := append(first, second...)
+	start1 := sectorIndex * 256
+	end2 := start1 + 512
+	directoryBlock := data[start1:end2]
 
-	return directoryBlock
+	return directoryBlock, nil
 }
 
-func getSectors(grt []byte, firstCluster byte, lastCluster byte, lastSector int, sectorsPerGroup int) []int {
+func getSectors(grt []byte, firstCluster byte, lastCluster byte, lastSector int, sectorsPerGroup int) ([]int, error) {
 	sectors := []int{}
 
 	index := firstCluster
 	max := sectorsPerGroup
 
+	// a chain cannot hold more groups than the GRT has entries
+	groupCount := 0
+
 	need_one := true
 	for index != 0 || need_one {
+		if groupCount == len(grt) {
+			return sectors, utils.ChainLoopError{Start: int(firstCluster)}
+		}
+
 		if index == lastCluster {
 			max = lastSector
 		}
@@ -55,18 +74,37 @@ func getSectors(grt []byte, firstCluster byte, lastCluster byte, lastSector int,
 
 		index = grt[index]
 		need_one = false
+		groupCount += 1
 	}
 
-	return sectors
+	return sectors, nil
+}
+
+// a date is a 16-bit word: day (bits 0-4), month 1-12 (bits 5-8), year since 1970 (bits 9-15)
+func decodeDate(dateBytes []byte) (int, int, int) {
+	word := int(dateBytes[0]) + int(dateBytes[1])*256
+
+	day := word & 0x1F
+	month := (word >> 5) & 0x0F
+	year := (word >> 9) + 1970
+
+	return day, month, year
 }
 
 func dateToText(dateBytes []byte) string {
 	monthNames := [12]string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
 
-	day := int((dateBytes[0] & 0xF8) >> 3)
-	month := int((dateBytes[0]&0x03)<<1) + int((dateBytes[1]&0x80)>>7)
-	monthName := monthNames[month]
-	year := int((dateBytes[1]&0x7E)>>1) + 1970
+	day, month, year := decodeDate(dateBytes)
+
+	monthName := "???"
+	if month >= 1 && month <= 12 {
+		monthName = monthNames[month-1]
+	}
+
+	// disks initialized without a date have all zero bytes
+	if month == 0 && day == 0 {
+		monthName = monthNames[0]
+	}
 
 	s := fmt.Sprintf("%02d-%s-%02d", day, monthName, year)
 
@@ -103,73 +141,6 @@ func flagsToText(flags byte) string {
 	return text
 }
 
-func printDirectoryBlock(directoryBlock []byte, grtSector []byte, sectorsPerGroup int, details bool) {
-	// parse and print 22 entries of 23 bytes each
-	for i := 0; i < 22; i++ {
-		start := i * 23
-		end := start + 23
-		entry := directoryBlock[start:end]
-		nameBytes := entry[0:8]
-		if nameBytes[0] < 0xfe {
-			extensionBytes := entry[8:11]
-			name := string(utils.TrimSlice(nameBytes))
-			extension := string(utils.TrimSlice(extensionBytes))
-			project := entry[12]
-			version := entry[13]
-			flagByte := entry[14]
-			flags := flagsToText(flagByte)
-
-			modifyDateBytes := entry[21:23]
-			modifyDate := dateToText(modifyDateBytes)
-
-			firstCluster := entry[16]
-			lastCluster := entry[17]
-			lastSector := int(entry[18])
-			usedSectors := getSectors(grtSector, firstCluster, lastCluster, lastSector, sectorsPerGroup)
-			usedSectorCount := len(usedSectors)
-
-			if details {
-				createDateBytes := entry[19:21]
-				createDate := dateToText(createDateBytes)
-
-				allocSectors := getSectors(grtSector, firstCluster, lastCluster, sectorsPerGroup, sectorsPerGroup)
-				allocSectorCount := len(allocSectors)
-
-				fmt.Printf("%-8s.%-3s[%04d];%03d    %s     %s    %s   %4d   %4d\n", name, extension, project, version, flags, createDate, modifyDate, usedSectorCount, allocSectorCount)
-			} else {
-				fmt.Printf("%-8s.%-3s    %s     %s   %4d\n", name, extension, flags, modifyDate, usedSectorCount)
-			}
-		}
-	}
-}
-
-func getFileSectors(wantedName string, directoryBlock []byte, grtSector []byte, sectorsPerGroup int) ([]int, bool) {
-	// parse and print 22 entries of 23 bytes each
-	for i := 0; i < 22; i++ {
-		start := i * 23
-		end := start + 23
-		entry := directoryBlock[start:end]
-		nameBytes := entry[0:8]
-		if nameBytes[0] < 0xfe {
-			extensionBytes := entry[8:11]
-			name := string(utils.TrimSlice(nameBytes))
-			extension := string(utils.TrimSlice(extensionBytes))
-
-			firstCluster := entry[16]
-			lastCluster := entry[17]
-			lastSector := int(entry[18])
-			usedSectors := getSectors(grtSector, firstCluster, lastCluster, lastSector, sectorsPerGroup)
-
-			filename := name + "." + extension
-			if filename == wantedName {
-				return usedSectors, true
-			}
-		}
-	}
-
-	return []int{}, false
-}
-
 type Label struct {
 	Serial int
 	Date []byte
@@ -186,7 +157,11 @@ type Label struct {
 	Text string
 }
 
-func (label *Label) Init(sector []byte) {
+func (label *Label) Init(sector []byte) error {
+	if len(sector) < 256 {
+		return errors.New("Label sector is too short")
+	}
+
 	// serial number
 	label.Serial = int(sector[0])
 
@@ -239,6 +214,8 @@ func (label *Label) Init(sector []byte) {
 	label.Text = string(labelBytes)
 
 	// if version 20h: num sectors match flags 0 => 400 1 => 800 2 => 800 3 => 1600
+
+	return nil
 }
 
 func (label Label) Print() {
@@ -257,101 +234,110 @@ func (label Label) Print() {
 	fmt.Printf("Label: %s\n", label.Text)
 }
 
-func catCommand(data []byte, label Label, grtSector []byte) {
-	fmt.Println("Name                      Flags    Created        Modified      Used  Allocated")
+func readLabel(data []byte) (Label, error) {
+	label := Label{}
 
-	// start with first directory sector
-	sectorIndex := label.Dir
+	// read sector 9
+	sectorNumber := 9
+	sectorBytes, err := utils.GetSector(data, sectorNumber)
+	if err != nil {
+		return label, err
+	}
 
-	for sectorIndex != 0 {
-		directoryBlock := readSectorPair(data, sectorIndex)
-		printDirectoryBlock(directoryBlock, grtSector, label.Spg, true)
+	err = label.Init(sectorBytes)
 
-		// read 6 bytes
-		vectorBytes := directoryBlock[506:512]
+	return label, err
+}
 
-		// bytes [4] and [5] are index of next directory pair
-		sectorIndex = int(vectorBytes[4]) + int(vectorBytes[5])*256
-	}
 
-	fmt.Println()
-}
+func printDirectoryEntry(fileEntry utils.FileEntry, volume Volume, details bool) error {
+	entry := fileEntry.Sys.(DirectoryEntry)
 
-func dirCommand(data []byte, label Label, grtSector []byte) {
-	fmt.Println("Name            Flags    Modified      Used")
+	name := entry.name()
+	extension := entry.extension()
+	flags := flagsToText(entry.Flags)
+	modifyDate := dateToText(entry.ModifyDate[:])
+	usedSectorCount := int(fileEntry.Size / 256)
 
-	// start with first directory sector
-	sectorIndex := label.Dir
+	if details {
+		project := entry.Project
+		version := entry.Version
+		createDate := dateToText(entry.CreateDate[:])
 
-	for sectorIndex != 0 {
-		directoryBlock := readSectorPair(data, sectorIndex)
-		printDirectoryBlock(directoryBlock, grtSector, label.Spg, false)
+		allocSectors, err := volume.allocatedSectors(entry)
+		if err != nil {
+			return err
+		}
 
-		// read 6 bytes
-		vectorBytes := directoryBlock[506:512]
+		allocSectorCount := len(allocSectors)
 
-		// bytes [4] and [5] are index of next directory pair
-		sectorIndex = int(vectorBytes[4]) + int(vectorBytes[5])*256
+		fmt.Printf("%-8s.%-3s[%04d];%03d    %s     %s    %s   %4d   %4d\n", name, extension, project, version, flags, createDate, modifyDate, usedSectorCount, allocSectorCount)
+	} else {
+		fmt.Printf("%-8s.%-3s    %s     %s   %4d\n", name, extension, flags, modifyDate, usedSectorCount)
 	}
 
-	fmt.Println()
+	return nil
 }
 
-func fileSectors(data []byte, label Label, grtSector []byte, wantedFilename string) ([]int, bool) {
-	// start with first directory sector
-	sectorIndex := label.Dir
+func listCommand(volume Volume, details bool) {
+	fileEntries, err := volume.Entries()
+
+	for _, fileEntry := range fileEntries {
+		printErr := printDirectoryEntry(fileEntry, volume, details)
+		if err == nil {
+			err = printErr
+		}
+	}
 
-	fileSectors := []int{}
+	if err != nil {
+		fmt.Println(err.Error())
+	}
 
-	found := false
+	fmt.Println()
+}
 
-	for sectorIndex != 0 && !found {
-		directoryBlock := readSectorPair(data, sectorIndex)
-		fileSectors, found = getFileSectors(wantedFilename, directoryBlock, grtSector, label.Spg)
+func catCommand(volume Volume) {
+	fmt.Println("Name                      Flags    Created        Modified      Used  Allocated")
 
-		// read 6 bytes
-		vectorBytes := directoryBlock[506:512]
+	listCommand(volume, true)
+}
 
-		// bytes [4] and [5] are index of next directory pair
-		sectorIndex = int(vectorBytes[4]) + int(vectorBytes[5])*256
-	}
+func dirCommand(volume Volume) {
+	fmt.Println("Name            Flags    Modified      Used")
 
-	return fileSectors, found
+	listCommand(volume, false)
 }
 
-func typeCommand(data []byte, label Label, grtSector []byte, filename string) {
-	sectorNumbers, found := fileSectors(data, label, grtSector, filename)
+func typeCommand(fileSystem utils.FileSystem, filename string) {
+	reader, err := fileSystem.Open(filename)
 
-	if found {
-		// for each sector
-		for _, sectorNumber := range sectorNumbers {
-			start1 := sectorNumber * 256
-			end1 := start1 + 256
-			sectorBytes := data[start1:end1]
-			text := string(sectorBytes)
-			fmt.Print(text)
-		}
+	if err == nil {
+		contents, _ := ioutil.ReadAll(reader)
+		text := string(contents)
+		fmt.Print(text)
 
 		fmt.Println()
 		fmt.Println()
 	} else {
-		fmt.Println("File not found")
+		fmt.Println(err.Error())
 	}
 
 	fmt.Println()
 }
 
-func dumpCommand(data []byte, label Label, grtSector []byte, filename string, format string) {
-	sectorNumbers, found := fileSectors(data, label, grtSector, filename)
+func dumpCommand(fileSystem utils.FileSystem, filename string, format string) {
+	reader, err := fileSystem.Open(filename)
 
-	if found {
+	if err == nil {
 		fmt.Println()
 
+		contents, _ := ioutil.ReadAll(reader)
+
 		// for each sector
-		for i, sectorNumber := range sectorNumbers {
-			start1 := sectorNumber * 256
+		for i := 0; i*256 < len(contents); i++ {
+			start1 := i * 256
 			end1 := start1 + 256
-			sectorBytes := data[start1:end1]
+			sectorBytes := contents[start1:end1]
 			utils.Dump(sectorBytes, i, format)
 			fmt.Println()
 		}
@@ -359,82 +345,79 @@ func dumpCommand(data []byte, label Label, grtSector []byte, filename string, fo
 		fmt.Println()
 		fmt.Println()
 	} else {
-		fmt.Println("File not found")
+		fmt.Println(err.Error())
 	}
 
 	fmt.Println()
 }
 
-func exportCommand(data []byte, label Label, grtSector []byte, filename string, exportDirectory string) {
-	sectorNumbers, found := fileSectors(data, label, grtSector, filename)
+func sameName(filename string) string {
+	return filename
+}
 
-	if found {
-		fmt.Println("Exporting file...")
+func exportCommand(exporter *utils.Exporter, filename string) error {
+	var err error
 
-		// open file
-		exportFilename := exportDirectory + "/" + filename
-		f, err := os.Create(exportFilename)
-		defer f.Close()
+	if utils.HasWildcards(filename) {
+		fmt.Println("Exporting files...")
 
-		if err != nil {
-			fmt.Println("Cannot open file")
-			return
-		}
+		summary, exportErr := exporter.ExportFiles(filename)
+		summary.Print()
+		err = exportErr
+	} else {
+		fmt.Println("Exporting file...")
 
-		// for each sector
-		for _, sectorNumber := range sectorNumbers {
-			start1 := sectorNumber * 256
-			end1 := start1 + 256
-			sectorBytes := data[start1:end1]
-			// write sector
-			f.Write(sectorBytes)
+		err = exporter.ExportFile(filename)
+		if err == nil {
+			fmt.Println("Done")
 		}
-
-		fmt.Println("Done")
-	} else {
-		fmt.Println("File not found")
 	}
 
-	fmt.Println()
-}
+	// write the manifest, even after a failure
+	closeErr := exporter.Close()
+	if err == nil {
+		err = closeErr
+	}
 
-func readLabel(data []byte) (Label) {
-	label := Label{}
+	if err != nil {
+		fmt.Println(err.Error())
+	}
 
-	// read sector 9
-	sectorNumber := 9
-	start1 := sectorNumber * 256
-	end1 := start1 + 256
-	sectorBytes := data[start1:end1]
-	label.Init(sectorBytes)
+	fmt.Println()
 
-	return label
+	return err
 }
 
-func Export(data []byte, exportSpec string, exportDirectory string) {
-	label := readLabel(data)
+func Export(data []byte, exportSpec string, exportDirectory string, metadataMode utils.MetadataMode) error {
+	volume := Volume{}
+	err := volume.Init(data)
+	if err != nil {
+		return err
+	}
 
-	// read Group Reservation Table (GRT)
-	start1 := label.Grt * 256
-	end1 := start1 + 256
-	sectorBytes := data[start1:end1]
+	exporter := utils.Exporter{}
+	exporter.Init(volume, exportDirectory, sameName, metadataMode)
 
-	exportCommand(data, label, sectorBytes, exportSpec, exportDirectory)
+	return exportCommand(&exporter, exportSpec)
 }
 
-func Cat(data []byte) {
-	label := readLabel(data)
+func Cat(data []byte) error {
+	volume := Volume{}
+	err := volume.Init(data)
+	if err != nil {
+		return err
+	}
 
-	// read Group Reservation Table (GRT)
-	start1 := label.Grt * 256
-	end1 := start1 + 256
-	sectorBytes := data[start1:end1]
+	dirCommand(volume)
 
-	dirCommand(data, label, sectorBytes)
+	return nil
 }
 
-func Menu(reader *bufio.Reader, data []byte, exportDirectory string) {
-	label := readLabel(data)
+func Menu(reader *bufio.Reader, data []byte, exportDirectory string, metadataMode utils.MetadataMode) error {
+	label, err := readLabel(data)
+	if err != nil {
+		return err
+	}
 
 	// check text label
 	labelError := false
@@ -448,10 +431,12 @@ func Menu(reader *bufio.Reader, data []byte, exportDirectory string) {
 		fmt.Println("This disk has a strange label")
 	}
 
-	// read Group Reservation Table (GRT)
-	start1 := label.Grt * 256
-	end1 := start1 + 256
-	grtSector := data[start1:end1]
+	volume := Volume{}
+	err = volume.Init(data)
+	if err != nil {
+		return err
+	}
+
 	dump_format := "octal"
 
 	// prompt for command and process it
@@ -460,7 +445,9 @@ func Menu(reader *bufio.Reader, data []byte, exportDirectory string) {
 		// display prompt and read command
 		fmt.Printf("HDOS> ")
 		line, err := reader.ReadString('\n')
-		utils.CheckAndExit(err)
+		if err != nil {
+			return err
+		}
 
 		// process the command
 		line = strings.TrimSpace(line)
@@ -473,17 +460,20 @@ func Menu(reader *bufio.Reader, data []byte, exportDirectory string) {
 		} else if parts[0] == "stats" {
 			label.Print()
 
-			freeSectors := getSectors(grtSector, 0, 0, label.Spg, label.Spg)
-			freeSectorCount := len(freeSectors)
+			freeSpace, err := volume.FreeSpace()
+			freeSectorCount := freeSpace / 256
 			fmt.Printf("Free sectors: %d\n", freeSectorCount)
+			if err != nil {
+				fmt.Println(err.Error())
+			}
 			fmt.Println()
 		} else if parts[0] == "cat" {
-			catCommand(data, label, grtSector)
+			catCommand(volume)
 		} else if parts[0] == "dir" {
-			dirCommand(data, label, grtSector)
+			dirCommand(volume)
 		} else if parts[0] == "type" {
 			if len(parts) > 1 {
-				typeCommand(data, label, grtSector, parts[1])
+				typeCommand(volume, parts[1])
 			} else {
 				fmt.Println("File name required")
 			}
@@ -493,19 +483,55 @@ func Menu(reader *bufio.Reader, data []byte, exportDirectory string) {
 				if len(parts) > 2 {
 					format = parts[2]
 				}
-				dumpCommand(data, label, grtSector, parts[1], format)
+				dumpCommand(volume, parts[1], format)
 			} else {
 				fmt.Println("File name required")
 			}
 		} else if parts[0] == "export" {
 			if len(parts) > 1 {
-				exportCommand(data, label, grtSector, parts[1], exportDirectory)
+				exporter := utils.Exporter{}
+				exporter.Init(volume, exportDirectory, sameName, metadataMode)
+				exportCommand(&exporter, parts[1])
 			} else {
 				fmt.Println("File name required")
 			}
+		} else if parts[0] == "import" {
+			hostFilename, options, err := importArguments(parts)
+			if err == nil {
+				importCommand(volume, hostFilename, options)
+			} else {
+				fmt.Println(err.Error())
+			}
+		} else if parts[0] == "delete" {
+			deleteCommand(volume, parts)
+		} else if parts[0] == "rename" {
+			renameCommand(volume, parts)
+		} else if parts[0] == "init" {
+			err = initCommand(data, parts)
+			if err == nil {
+				label, _ = readLabel(data)
+				volume.Init(data)
+			}
+		} else if parts[0] == "check" || parts[0] == "fsck" {
+			checkCommand(data)
+		} else if parts[0] == "repair" {
+			repairCommand(data, parts)
+		} else if parts[0] == "metadata" {
+			if len(parts) > 1 {
+				mode, err := utils.ParseMetadataMode(parts[1])
+				if err == nil {
+					metadataMode = mode
+				} else {
+					fmt.Println(err.Error())
+				}
+			}
+			fmt.Printf("Metadata: %s\n", metadataMode)
+			fmt.Println()
 		} else {
 			help()
 			fmt.Println()
 		}
 	}
+
+	return nil
 }
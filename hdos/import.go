@@ -0,0 +1,351 @@
+/*
+Package hdos of H-8/H-89 disk reader
+*/
+package hdos
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jfitz/h8d-examiner/utils"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ImportOptions are the directory fields of an imported file
+type ImportOptions struct {
+	Name    string // NAME.EXT on the disk, empty to use the host file name
+	Flags   byte
+	Project byte
+	Version byte
+	Date    time.Time // modified, and created unless Created is set
+	Created time.Time
+}
+
+// the zero time is written as a zero date (shown as 00-JAN-1970)
+func encodeDate(t time.Time) [2]byte {
+	if t.IsZero() {
+		return [2]byte{0, 0}
+	}
+
+	word := t.Day() + int(t.Month())<<5 + (t.Year()-1970)<<9
+
+	return [2]byte{byte(word % 256), byte(word / 256)}
+}
+
+// TextToDate converts a date as shown by cat (15-JUN-1981) to a time
+func TextToDate(text string) (time.Time, error) {
+	if text == "00-JAN-1970" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse("02-Jan-2006", text)
+	if err != nil || t.Year() < 1970 || t.Year() > 1970+127 {
+		return time.Time{}, errors.New("Bad HDOS date " + text)
+	}
+
+	return t, nil
+}
+
+// ImportOptions returns the options that write a file with this metadata
+func (metadata FileMetadata) ImportOptions() (ImportOptions, error) {
+	options := ImportOptions{
+		Name:    metadata.Name,
+		Project: byte(metadata.Project),
+		Version: byte(metadata.Version),
+	}
+
+	flags, err := TextToFlags(metadata.Flags)
+	if err != nil {
+		return options, err
+	}
+
+	options.Flags = flags
+
+	options.Created, err = TextToDate(metadata.CreateDate)
+	if err != nil {
+		return options, err
+	}
+
+	options.Date, err = TextToDate(metadata.ModifyDate)
+	if err != nil {
+		return options, err
+	}
+
+	return options, nil
+}
+
+// TextToFlags converts flag letters (S, L, W, C) to the flags byte
+func TextToFlags(text string) (byte, error) {
+	flags := byte(0)
+
+	for _, c := range strings.ToUpper(text) {
+		if c == 'S' {
+			flags |= 0200
+		} else if c == 'L' {
+			flags |= 0100
+		} else if c == 'W' {
+			flags |= 0040
+		} else if c == 'C' {
+			flags |= 0020
+		} else {
+			return flags, errors.New("Flags must be S, L, W, or C")
+		}
+	}
+
+	return flags, nil
+}
+
+func validName(text string, maxLength int) bool {
+	if len(text) > maxLength {
+		return false
+	}
+
+	for i, c := range text {
+		letter := c >= 'A' && c <= 'Z'
+		digit := c >= '0' && c <= '9'
+
+		// names start with a letter
+		if !letter && (i == 0 || !digit) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// convert NAME.EXT to directory fields
+func nameToFields(filename string) ([8]byte, [3]byte, error) {
+	name := [8]byte{}
+	extension := [3]byte{}
+
+	parts := strings.SplitN(strings.ToUpper(filename), ".", 2)
+	if len(parts) == 1 {
+		parts = append(parts, "")
+	}
+
+	if len(parts[0]) == 0 || !validName(parts[0], 8) || !validName(parts[1], 3) {
+		return name, extension, errors.New("Bad HDOS file name " + filename)
+	}
+
+	copy(name[:], parts[0])
+	copy(extension[:], parts[1])
+
+	return name, extension, nil
+}
+
+func (entry DirectoryEntry) bytes() []byte {
+	bs := make([]byte, 23)
+
+	copy(bs[0:8], entry.Name[:])
+	copy(bs[8:11], entry.Extension[:])
+	bs[11] = entry.Reserved1
+	bs[12] = entry.Project
+	bs[13] = entry.Version
+	bs[14] = entry.Flags
+	bs[15] = entry.Reserved2
+	bs[16] = entry.FirstCluster
+	bs[17] = entry.LastCluster
+	bs[18] = entry.LastSector
+	copy(bs[19:21], entry.CreateDate[:])
+	copy(bs[21:23], entry.ModifyDate[:])
+
+	return bs
+}
+
+// image offset of the first empty or deleted directory slot
+func (volume Volume) freeSlot() (int, error) {
+	slots, err := volume.directorySlots()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, slot := range slots {
+		if volume.data[slot] >= 0xfe {
+			return slot, nil
+		}
+	}
+
+	return 0, utils.ErrDirectoryFull
+}
+
+// take groups from the front of the free chain (group 0 of the GRT)
+func (volume Volume) allocateGroups(count int) ([]int, error) {
+	groups := []int{}
+
+	index := int(volume.grt[0])
+
+	for len(groups) < count {
+		if index == 0 {
+			return groups, utils.ErrDiskFull
+		}
+
+		if len(groups) == len(volume.grt) {
+			return groups, utils.ChainLoopError{Start: int(volume.grt[0])}
+		}
+
+		groups = append(groups, index)
+		index = int(volume.grt[index])
+	}
+
+	// the rest of the chain stays free, and the file chain ends
+	volume.grt[0] = byte(index)
+	volume.grt[groups[len(groups)-1]] = 0
+
+	return groups, nil
+}
+
+// write a file into the volume
+func (volume Volume) writeFile(contents []byte, options ImportOptions) error {
+	name, extension, err := nameToFields(options.Name)
+	if err != nil {
+		return err
+	}
+
+	filename := strings.TrimRight(string(name[:]), "\x00") + "." + strings.TrimRight(string(extension[:]), "\x00")
+
+	_, err = volume.findEntry(filename)
+	if err == nil {
+		return utils.ErrFileExists
+	}
+
+	if err != utils.ErrFileNotFound {
+		return err
+	}
+
+	slot, err := volume.freeSlot()
+	if err != nil {
+		return err
+	}
+
+	// every file has at least one sector (zeroed for an empty file), as HDOS writes it
+	sectorCount := (len(contents) + 255) / 256
+	if sectorCount == 0 {
+		sectorCount = 1
+	}
+	spg := volume.label.Spg
+	groupCount := (sectorCount + spg - 1) / spg
+
+	groups, err := volume.allocateGroups(groupCount)
+	if err != nil {
+		return err
+	}
+
+	date := encodeDate(options.Date)
+
+	createDate := date
+	if !options.Created.IsZero() {
+		createDate = encodeDate(options.Created)
+	}
+
+	entry := DirectoryEntry{
+		Name:         name,
+		Extension:    extension,
+		Project:      options.Project,
+		Version:      options.Version,
+		Flags:        options.Flags,
+		FirstCluster: byte(groups[0]),
+		LastCluster:  byte(groups[len(groups)-1]),
+		LastSector:   byte(sectorCount - (groupCount-1)*spg),
+		CreateDate:   createDate,
+		ModifyDate:   date,
+	}
+
+	// copy the contents, padding the last sector with zeros
+	sectors, err := volume.usedSectors(entry)
+	if err != nil {
+		return err
+	}
+
+	for i, sector := range sectors {
+		sectorBytes, err := utils.GetSector(volume.data, sector)
+		if err != nil {
+			return err
+		}
+
+		start := i * 256
+		end := start + 256
+		if end > len(contents) {
+			end = len(contents)
+		}
+
+		n := copy(sectorBytes, contents[start:end])
+		for j := n; j < 256; j++ {
+			sectorBytes[j] = 0
+		}
+	}
+
+	copy(volume.data[slot:slot+23], entry.bytes())
+
+	return nil
+}
+
+func importCommand(volume Volume, hostFilename string, options ImportOptions) error {
+	fmt.Println("Importing file...")
+
+	if len(options.Name) == 0 {
+		options.Name = filepath.Base(hostFilename)
+	}
+
+	contents, err := ioutil.ReadFile(hostFilename)
+	if err == nil {
+		err = volume.writeFile(contents, options)
+	}
+
+	if err == nil {
+		fmt.Println("Done")
+	} else {
+		fmt.Println(err.Error())
+	}
+
+	fmt.Println()
+
+	return err
+}
+
+// arguments of the import command: HOSTFILE [NAME.EXT [FLAGS]]
+func importArguments(parts []string) (string, ImportOptions, error) {
+	options := ImportOptions{Date: time.Now()}
+
+	if len(parts) < 2 {
+		return "", options, errors.New("File name required")
+	}
+
+	if len(parts) > 2 {
+		options.Name = parts[2]
+	}
+
+	if len(parts) > 3 {
+		flags, err := TextToFlags(parts[3])
+		if err != nil {
+			return "", options, err
+		}
+
+		options.Flags = flags
+	}
+
+	return parts[1], options, nil
+}
+
+// Import copies a host file into the image data
+func Import(data []byte, hostFilename string, options ImportOptions) error {
+	volume := Volume{}
+	err := volume.Init(data)
+	if err != nil {
+		return err
+	}
+
+	return importCommand(volume, hostFilename, options)
+}
+
+// WriteFile writes the contents of a file into the image data
+func WriteFile(data []byte, contents []byte, options ImportOptions) error {
+	volume := Volume{}
+	err := volume.Init(data)
+	if err != nil {
+		return err
+	}
+
+	return volume.writeFile(contents, options)
+}
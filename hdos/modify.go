@@ -0,0 +1,172 @@
+/*
+Package hdos of H-8/H-89 disk reader
+*/
+package hdos
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jfitz/h8d-examiner/utils"
+	"strings"
+)
+
+// image offset and contents of the directory slot for a file, in any case
+func (volume Volume) findSlot(filename string) (int, DirectoryEntry, error) {
+	filename = strings.ToUpper(filename)
+	slots, err := volume.directorySlots()
+
+	for _, slot := range slots {
+		entry := DirectoryEntry{}
+		entry.Init(volume.data[slot : slot+23])
+
+		if entry.inUse() && entry.filename() == filename {
+			return slot, entry, nil
+		}
+	}
+
+	if err != nil {
+		return 0, DirectoryEntry{}, err
+	}
+
+	return 0, DirectoryEntry{}, utils.ErrFileNotFound
+}
+
+// files of the volume structure, made by Format
+var systemFiles = []string{"RGT.SYS", "GRT.SYS", "DIRECT.SYS"}
+
+// IsSystemFile reports a file of the volume structure (never deleted, renamed or packed)
+func IsSystemFile(filename string) bool {
+	for _, name := range systemFiles {
+		if name == filename {
+			return true
+		}
+	}
+
+	return false
+}
+
+// files with the L or W flag may be changed only when forced
+func protected(entry DirectoryEntry) bool {
+	return strings.ContainsAny(flagsToText(entry.Flags), "LW")
+}
+
+// remove a file and return its groups to the free chain
+// the volume structure files stay, even when forced
+func (volume Volume) deleteFile(filename string, force bool) error {
+	if IsSystemFile(strings.ToUpper(filename)) {
+		return utils.ErrSystemFile
+	}
+
+	slot, entry, err := volume.findSlot(filename)
+	if err != nil {
+		return err
+	}
+
+	if protected(entry) && !force {
+		return utils.ErrFileProtected
+	}
+
+	groups, err := volume.groupChain(entry)
+	if err != nil {
+		return err
+	}
+
+	// the file chain goes in front of the free chain
+	if len(groups) > 0 {
+		volume.grt[groups[len(groups)-1]] = volume.grt[0]
+		volume.grt[0] = byte(groups[0])
+	}
+
+	// 0xFE would end the directory and hide later files
+	volume.data[slot] = 0xff
+
+	return nil
+}
+
+// change the name and extension of a file
+func (volume Volume) renameFile(filename string, newFilename string, force bool) error {
+	if IsSystemFile(strings.ToUpper(filename)) || IsSystemFile(newFilename) {
+		return utils.ErrSystemFile
+	}
+
+	slot, entry, err := volume.findSlot(filename)
+	if err != nil {
+		return err
+	}
+
+	if protected(entry) && !force {
+		return utils.ErrFileProtected
+	}
+
+	name, extension, err := nameToFields(newFilename)
+	if err != nil {
+		return err
+	}
+
+	entry.Name = name
+	entry.Extension = extension
+
+	_, err = volume.findEntry(entry.filename())
+	if err == nil {
+		return utils.ErrFileExists
+	}
+
+	if err != utils.ErrFileNotFound {
+		return err
+	}
+
+	copy(volume.data[slot:slot+23], entry.bytes())
+
+	return nil
+}
+
+// optional last argument of delete and rename
+func forceArgument(parts []string, count int) (bool, error) {
+	if len(parts) < count {
+		return false, errors.New("File name required")
+	}
+
+	if len(parts) == count {
+		return false, nil
+	}
+
+	if len(parts) == count+1 && parts[count] == "force" {
+		return true, nil
+	}
+
+	return false, errors.New("Unexpected argument " + parts[len(parts)-1])
+}
+
+func deleteCommand(volume Volume, parts []string) error {
+	force, err := forceArgument(parts, 2)
+	if err == nil {
+		err = volume.deleteFile(parts[1], force)
+	}
+
+	if err == nil {
+		fmt.Printf("Deleted %s\n", strings.ToUpper(parts[1]))
+	} else {
+		fmt.Println(err.Error())
+	}
+
+	fmt.Println()
+
+	return err
+}
+
+func renameCommand(volume Volume, parts []string) error {
+	force, err := forceArgument(parts, 3)
+	if err == nil {
+		err = volume.renameFile(parts[1], strings.ToUpper(parts[2]), force)
+	}
+
+	if err == nil {
+		fmt.Printf("Renamed %s to %s\n", strings.ToUpper(parts[1]), strings.ToUpper(parts[2]))
+	} else {
+		fmt.Println(err.Error())
+	}
+
+	fmt.Println()
+
+	return err
+}
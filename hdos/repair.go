@@ -0,0 +1,190 @@
+/*
+Package hdos of H-8/H-89 disk reader
+*/
+package hdos
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jfitz/h8d-examiner/utils"
+)
+
+// follow the chain of a file until it ends, loops, leaves the disk or reaches another file
+// returns the groups and whether the chain ended properly
+func repairChain(grt []byte, first int, groupCount int, owners map[int]string) ([]int, bool) {
+	groups := []int{}
+	seen := map[int]bool{}
+
+	for index := first; index != 0; index = int(grt[index]) {
+		_, owned := owners[index]
+		if index >= groupCount || seen[index] || owned {
+			return groups, false
+		}
+
+		seen[index] = true
+		groups = append(groups, index)
+	}
+
+	return groups, true
+}
+
+// the free chain is kept if it holds exactly the free groups
+func freeChainValid(grt []byte, groupCount int, free []int) bool {
+	chain, complete := repairChain(grt, int(grt[0]), groupCount, map[int]string{})
+	if !complete || len(chain) != len(free) {
+		return false
+	}
+
+	inChain := map[int]bool{}
+	for _, group := range chain {
+		inChain[group] = true
+	}
+
+	for _, group := range free {
+		if !inChain[group] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Repair returns a copy of the image with file chains cut where they go wrong
+// and the free chain rebuilt from the groups no file uses, with a list of the changes
+func Repair(data []byte) ([]byte, []string, error) {
+	changes := []string{}
+	repaired := append([]byte{}, data...)
+
+	volume := Volume{}
+	err := volume.Init(repaired)
+	if err != nil {
+		return repaired, changes, err
+	}
+
+	spg := volume.label.Spg
+	if spg != 1 && spg != 2 && spg != 4 && spg != 8 {
+		return repaired, changes, utils.ErrLabelDamaged
+	}
+
+	// without the whole directory, groups of the missing files would be freed
+	slots, err := volume.directorySlots()
+	if err != nil {
+		return repaired, changes, utils.ErrDirectoryDamaged
+	}
+
+	groupCount := volume.label.Siz / spg
+	if groupCount > len(volume.grt) {
+		groupCount = len(volume.grt)
+	}
+
+	oldGrt := append([]byte{}, volume.grt...)
+
+	// files earlier in the directory keep groups shared with later ones
+	owners := map[int]string{}
+
+	for _, slot := range slots {
+		entry := DirectoryEntry{}
+		entry.Init(repaired[slot : slot+23])
+
+		if !entry.inUse() {
+			continue
+		}
+
+		name := reportName(entry)
+
+		groups, complete := repairChain(volume.grt, int(entry.FirstCluster), groupCount, owners)
+		if len(groups) == 0 {
+			repaired[slot] = 0xff
+			changes = append(changes, fmt.Sprintf("%s: no usable groups, entry removed", name))
+			continue
+		}
+
+		last := groups[len(groups)-1]
+		fixed := entry
+
+		if !complete {
+			volume.grt[last] = 0
+			changes = append(changes, fmt.Sprintf("%s: chain cut after group %d", name, last))
+		}
+
+		// INIT.ABS 1.6 sometimes leaves the last group of DIRECT.SYS as 0
+		quirk := entry.filename() == "DIRECT.SYS" && entry.LastCluster == 0
+
+		if int(entry.LastCluster) != last && !quirk {
+			fixed.LastCluster = byte(last)
+			fixed.LastSector = byte(spg)
+		}
+
+		if fixed.LastSector == 0 || int(fixed.LastSector) > spg {
+			fixed.LastSector = byte(spg)
+		}
+
+		if fixed.LastCluster != entry.LastCluster {
+			changes = append(changes, fmt.Sprintf("%s: last group %d -> %d", name, entry.LastCluster, fixed.LastCluster))
+		}
+
+		if fixed.LastSector != entry.LastSector {
+			changes = append(changes, fmt.Sprintf("%s: last sector %d -> %d", name, entry.LastSector, fixed.LastSector))
+		}
+
+		copy(repaired[slot:slot+23], fixed.bytes())
+
+		for _, group := range groups {
+			owners[group] = name
+		}
+	}
+
+	// boot sectors and the label (sector 9) are reserved, as are groups marked 0xFF
+	firstGroup := (10 + spg - 1) / spg
+
+	free := []int{}
+	for group := firstGroup; group < groupCount; group++ {
+		_, owned := owners[group]
+		if !owned && volume.grt[group] != 0xff {
+			free = append(free, group)
+		}
+	}
+
+	if !freeChainValid(volume.grt, groupCount, free) {
+		last := 0
+		for _, group := range free {
+			volume.grt[last] = byte(group)
+			last = group
+		}
+		volume.grt[last] = 0
+
+		changes = append(changes, fmt.Sprintf("Free chain rebuilt with %d groups", len(free)))
+	}
+
+	for i := range volume.grt {
+		if volume.grt[i] != oldGrt[i] {
+			changes = append(changes, fmt.Sprintf("GRT[%d]: %d -> %d", i, oldGrt[i], volume.grt[i]))
+		}
+	}
+
+	return repaired, changes, nil
+}
+
+// write a repaired copy of the volume to a new host file
+func repairCommand(data []byte, parts []string) {
+	var err error
+
+	if len(parts) < 2 {
+		err = errors.New("File name required")
+	}
+
+	if err == nil {
+		repaired, changes, repairErr := Repair(data)
+		err = repairErr
+
+		if err == nil {
+			err = utils.SaveRepair(parts[1], repaired, changes)
+		}
+	}
+
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+
+	fmt.Println()
+}
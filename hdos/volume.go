@@ -0,0 +1,344 @@
+/*
+Package hdos of H-8/H-89 disk reader
+*/
+package hdos
+
+import (
+	"bytes"
+	"github.com/jfitz/h8d-examiner/utils"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+type DirectoryEntry struct {
+	Name         [8]byte // 0-7
+	Extension    [3]byte // 8-10
+	Reserved1    byte    // 11
+	Project      byte    // 12
+	Version      byte    // 13
+	Flags        byte    // 14
+	Reserved2    byte    // 15
+	FirstCluster byte    // 16
+	LastCluster  byte    // 17
+	LastSector   byte    // 18
+	CreateDate   [2]byte // 19-20
+	ModifyDate   [2]byte // 21-22
+}
+
+func (entry *DirectoryEntry) Init(bs []byte) {
+	// name and extension
+	copy(entry.Name[:], bs[0:8])
+	copy(entry.Extension[:], bs[8:11])
+
+	entry.Reserved1 = bs[11]
+	entry.Project = bs[12]
+	entry.Version = bs[13]
+	entry.Flags = bs[14]
+	entry.Reserved2 = bs[15]
+
+	// group chain
+	entry.FirstCluster = bs[16]
+	entry.LastCluster = bs[17]
+	entry.LastSector = bs[18]
+
+	// dates
+	copy(entry.CreateDate[:], bs[19:21])
+	copy(entry.ModifyDate[:], bs[21:23])
+}
+
+// 0xFF is an empty slot, 0xFE is an empty slot with no used slots after it
+func (entry DirectoryEntry) inUse() bool {
+	return entry.Name[0] < 0xfe
+}
+
+func (entry DirectoryEntry) name() string {
+	return string(utils.TrimSlice(entry.Name[:]))
+}
+
+func (entry DirectoryEntry) extension() string {
+	return string(utils.TrimSlice(entry.Extension[:]))
+}
+
+func (entry DirectoryEntry) filename() string {
+	return entry.name() + "." + entry.extension()
+}
+
+func dateToTime(dateBytes []byte) time.Time {
+	day, month, year := decodeDate(dateBytes)
+
+	// disks initialized without a date have day zero
+	if day == 0 || month < 1 || month > 12 {
+		return time.Time{}
+	}
+
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+}
+
+// Volume is an HDOS file system in a disk image
+type Volume struct {
+	data  []byte
+	label Label
+	grt   []byte
+}
+
+func (volume *Volume) Init(data []byte) error {
+	label, err := readLabel(data)
+	if err != nil {
+		return err
+	}
+
+	// read Group Reservation Table (GRT)
+	grt, err := utils.GetSector(data, label.Grt)
+	if err != nil {
+		return err
+	}
+
+	volume.data = data
+	volume.label = label
+	volume.grt = grt
+
+	return nil
+}
+
+func (volume Volume) Label() Label {
+	return volume.label
+}
+
+// walk the directory chain and return the image offset of every slot
+func (volume Volume) directorySlots() ([]int, error) {
+	slots := []int{}
+
+	// start with first directory sector
+	sectorIndex := volume.label.Dir
+	seen := map[int]bool{}
+
+	for sectorIndex != 0 {
+		directoryBlock, err := readSectorPair(volume.data, sectorIndex)
+		if err != nil {
+			return slots, err
+		}
+
+		seen[sectorIndex] = true
+
+		// 22 entries of 23 bytes each
+		for i := 0; i < 22; i++ {
+			slots = append(slots, sectorIndex*256+i*23)
+		}
+
+		// read 6 bytes
+		vectorBytes := directoryBlock[506:512]
+
+		// bytes [4] and [5] are index of next directory pair
+		nextIndex := int(vectorBytes[4]) + int(vectorBytes[5])*256
+
+		if nextIndex != 0 && (seen[nextIndex] || (nextIndex+2)*256 > len(volume.data)) {
+			return slots, utils.DirectoryLinkError{Sector: sectorIndex, Link: nextIndex}
+		}
+
+		sectorIndex = nextIndex
+	}
+
+	return slots, nil
+}
+
+// walk the directory chain and return every slot
+func (volume Volume) directoryEntries() ([]DirectoryEntry, error) {
+	entries := []DirectoryEntry{}
+
+	slots, err := volume.directorySlots()
+
+	for _, slot := range slots {
+		entry := DirectoryEntry{}
+		entry.Init(volume.data[slot : slot+23])
+		entries = append(entries, entry)
+	}
+
+	return entries, err
+}
+
+func (volume Volume) usedSectors(entry DirectoryEntry) ([]int, error) {
+	lastSector := int(entry.LastSector)
+	return getSectors(volume.grt, entry.FirstCluster, entry.LastCluster, lastSector, volume.label.Spg)
+}
+
+func (volume Volume) allocatedSectors(entry DirectoryEntry) ([]int, error) {
+	return getSectors(volume.grt, entry.FirstCluster, entry.LastCluster, volume.label.Spg, volume.label.Spg)
+}
+
+func (volume Volume) fileEntry(entry DirectoryEntry) (utils.FileEntry, error) {
+	usedSectors, err := volume.usedSectors(entry)
+
+	fileEntry := utils.FileEntry{
+		Name:    entry.filename(),
+		Size:    int64(len(usedSectors)) * 256,
+		ModTime: dateToTime(entry.ModifyDate[:]),
+		Sys:     entry,
+	}
+
+	return fileEntry, err
+}
+
+func (volume Volume) findEntry(filename string) (DirectoryEntry, error) {
+	entries, err := volume.directoryEntries()
+
+	for _, entry := range entries {
+		if entry.inUse() && entry.filename() == filename {
+			return entry, nil
+		}
+	}
+
+	if err != nil {
+		return DirectoryEntry{}, err
+	}
+
+	return DirectoryEntry{}, utils.ErrFileNotFound
+}
+
+func (volume Volume) Entries() ([]utils.FileEntry, error) {
+	fileEntries := []utils.FileEntry{}
+
+	entries, err := volume.directoryEntries()
+
+	// list every file, and report the first problem
+	for _, entry := range entries {
+		if entry.inUse() {
+			fileEntry, entryErr := volume.fileEntry(entry)
+			if err == nil {
+				err = entryErr
+			}
+
+			fileEntries = append(fileEntries, fileEntry)
+		}
+	}
+
+	return fileEntries, err
+}
+
+func (volume Volume) Stat(filename string) (utils.FileEntry, error) {
+	entry, err := volume.findEntry(filename)
+	if err != nil {
+		return utils.FileEntry{}, err
+	}
+
+	return volume.fileEntry(entry)
+}
+
+func (volume Volume) readFile(filename string) ([]byte, error) {
+	contents := []byte{}
+
+	entry, err := volume.findEntry(filename)
+	if err != nil {
+		return contents, err
+	}
+
+	sectorNumbers, err := volume.usedSectors(entry)
+	if err != nil {
+		return contents, err
+	}
+
+	// for each sector
+	for _, sectorNumber := range sectorNumbers {
+		sectorBytes, err := utils.GetSector(volume.data, sectorNumber)
+		if err != nil {
+			return contents, err
+		}
+
+		contents = append(contents, sectorBytes...)
+	}
+
+	return contents, nil
+}
+
+func (volume Volume) Open(filename string) (io.ReadSeeker, error) {
+	contents, err := volume.readFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(contents), nil
+}
+
+func (volume Volume) freeSectorCount() (int, error) {
+	// the free list is the chain starting at group 0
+	freeSectors, err := getSectors(volume.grt, 0, 0, volume.label.Spg, volume.label.Spg)
+
+	return len(freeSectors), err
+}
+
+func (volume Volume) FreeSpace() (int64, error) {
+	freeSectorCount, err := volume.freeSectorCount()
+
+	return int64(freeSectorCount) * 256, err
+}
+
+// groups of a file, following the GRT from the first group
+func (volume Volume) groupChain(entry DirectoryEntry) ([]int, error) {
+	groups := []int{}
+
+	index := int(entry.FirstCluster)
+
+	for index != 0 {
+		if len(groups) == len(volume.grt) {
+			return groups, utils.ChainLoopError{Start: int(entry.FirstCluster)}
+		}
+
+		groups = append(groups, index)
+		index = int(volume.grt[index])
+	}
+
+	return groups, nil
+}
+
+// FileMetadata is what HDOS records about a file, for export
+type FileMetadata struct {
+	Name       string
+	Size       int64
+	CreateDate string
+	ModifyDate string
+	Project    int
+	Version    int
+	Flags      string // S, L, W, C
+	Groups     []int
+	LastSector int
+}
+
+func (volume Volume) Describe(filename string) (interface{}, error) {
+	entry, err := volume.findEntry(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	fileEntry, err := volume.fileEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := volume.groupChain(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := FileMetadata{
+		Name:       fileEntry.Name,
+		Size:       fileEntry.Size,
+		CreateDate: dateToText(entry.CreateDate[:]),
+		ModifyDate: dateToText(entry.ModifyDate[:]),
+		Project:    int(entry.Project),
+		Version:    int(entry.Version),
+		Flags:      strings.Replace(flagsToText(entry.Flags), " ", "", -1),
+		Groups:     groups,
+		LastSector: int(entry.LastSector),
+	}
+
+	return metadata, nil
+}
+
+// FS returns the volume as an io/fs file system
+func (volume Volume) FS() fs.FS {
+	fsys := utils.FS{}
+	fsys.Init(volume)
+
+	return fsys
+}
@@ -0,0 +1,69 @@
+/*
+Package of main IMD packer
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/jfitz/h8d-examiner/imd"
+	"github.com/jfitz/h8d-examiner/utils"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+func main() {
+	sidesPtr := flag.Int("sides", 1, "Sides (1 or 2)")
+	tracksPtr := flag.Int("tracks", 0, "Tracks per side (default from the image size)")
+	sectorsPtr := flag.Int("sectors", 10, "Sectors per track")
+	sizePtr := flag.Int("size", 256, "Bytes per sector")
+	firstPtr := flag.Int("first", 0, "Number of the first sector (H-17 0, H-37 1)")
+	interleavePtr := flag.Int("interleave", 1, "Sector interleave (skew) on the track")
+	modePtr := flag.Int("mode", 2, "IMD mode: 0-2 FM and 3-5 MFM at 500, 300, 250 kbps")
+	commentPtr := flag.String("comment", "", "Comment for the IMD header")
+
+	// parse command line options
+	flag.Parse()
+
+	args := flag.Args()
+
+	if len(args) < 2 {
+		fmt.Println("Usage: imd-pack [options] source-file destination-file")
+		os.Exit(1)
+	}
+
+	// get file names
+	source_fileName := args[0]
+	dest_filename := args[1]
+
+	data, err := ioutil.ReadFile(source_fileName)
+	utils.CheckAndExit(err)
+
+	geometry := imd.Geometry{
+		Sides:           *sidesPtr,
+		Tracks:          *tracksPtr,
+		SectorsPerTrack: *sectorsPtr,
+		SectorSize:      *sizePtr,
+		FirstSector:     *firstPtr,
+		Interleave:      *interleavePtr,
+		Mode:            *modePtr,
+	}
+
+	// tracks from the image size
+	trackSize := geometry.Sides * geometry.SectorsPerTrack * geometry.SectorSize
+	if geometry.Tracks == 0 && trackSize > 0 {
+		geometry.Tracks = len(data) / trackSize
+	}
+
+	header := imd.Header(time.Now(), *commentPtr)
+
+	image, err := imd.FromImage(data, geometry, header)
+	utils.CheckAndExit(err)
+
+	// never replace an existing file
+	err = utils.WriteNewFile(dest_filename, image.Encode())
+	utils.CheckAndExit(err)
+
+	fmt.Printf("Wrote %d tracks of %d sectors to %s\n", len(image.Tracks), geometry.SectorsPerTrack, dest_filename)
+}
@@ -4,178 +4,96 @@
 package main
 
 import (
-	"errors"
 	"flag"
 	"fmt"
+	"github.com/jfitz/h8d-examiner/imd"
 	"github.com/jfitz/h8d-examiner/utils"
-	"io"
+	"io/ioutil"
 	"os"
 )
 
-func read_normal_sector(fh *os.File) ([]byte, error) {
-	// read 256 bytes and dump
-	length := 256
-	sector := make([]byte, length)
+// show the header and a table of the tracks
+func printInfo(image imd.Image) {
+	fmt.Printf("Version: %s\n", image.Version())
+	fmt.Printf("Date: %s\n", image.Date())
+	fmt.Println("Comment:")
+	fmt.Println(image.Comment())
+	fmt.Println()
 
-	_, err := fh.Read(sector)
-	if err != nil {
-		return []byte{}, err
-	}
-
-	return sector, nil
-}
-
-func read_compressed_sector(fh *os.File) ([]byte, error) {
-	// read 1 byte and replicate 256 times and dump
-	b := make([]byte, 1)
-	_, err := fh.Read(b)
-	if err != nil {
-		return []byte{}, err
-	}
-
-	b0 := b[0]
-	length := 256
-	sector := make([]byte, length)
-	for i := range sector {
-		sector[i] = b0
-	}
-
-	return sector, nil
-}
-
-func read_sector(fh *os.File) ([]byte, error) {
-	sector := make([]byte, 0)
-
-	// read byte code
-	b := make([]byte, 1)
-	_, err := fh.Read(b)
-	if err != nil {
-		return sector, err
-	}
+	fmt.Println("Cyl Head Mode           Sectors  Size Interleave Compressed Bad")
 
-	b0 := b[0]
+	for _, track := range image.Tracks {
+		compressed := 0
+		bad := 0
 
-	// validate byte code
-	if b0 == 0x01 {
-		sector, err = read_normal_sector(fh)
-		if err != nil {
-			return sector, err
-		}
-	} else if b0 == 0x02 {
-		sector, err = read_compressed_sector(fh)
-		if err != nil {
-			return sector, err
-		}
+		for _, sector := range track.Sectors {
+			if sector.Compressed {
+				compressed += 1
+			}
 
-	} else {
-		pos, err := fh.Seek(0, os.SEEK_CUR)
-		if err != nil {
-			return sector, err
+			if !sector.Good() {
+				bad += 1
+			}
 		}
 
-		msg := fmt.Sprintf("Unknown byte code %02X at position %04X\n", b0, pos)
-		err = errors.New(msg)
-		return sector, err
+		fmt.Printf("%3d %4d %-14s %7d %5d %10d %10d %3d\n", track.Cylinder, track.Head, imd.ModeText(track.Mode), len(track.Sectors), track.SectorSize(), track.Interleave(), compressed, bad)
 	}
-
-	return sector, nil
-}
-
-func read_track_header(fh *os.File) ([]byte, error) {
-	sector_map := make([]byte, 0)
-
-	// read track header
-	header := make([]byte, 5)
-	_, err := fh.Read(header)
-	if err != nil {
-		return sector_map, err
-	}
-
-	// side (0x01 or 0x02)
-	// track (0x00 to 0x27)
-	// 00
-	// number of sectors (0x0A)
-	// first sector (0x01)
-
-	num_sectors := int(header[3])
-	sector_map = make([]byte, num_sectors)
-	_, err = fh.Read(sector_map)
-	if err != nil {
-		return sector_map, err
-	}
-
-	// sector map[number of sectors]
-
-	return sector_map, nil
 }
 
 func main() {
+	infoPtr := flag.Bool("info", false, "Show the header and tracks, and write nothing")
+
 	// parse command line options
 	flag.Parse()
 
 	args := flag.Args()
 
-	if len(args) < 2 {
+	info := *infoPtr
+
+	if len(args) < 1 || (len(args) < 2 && !info) {
 		fmt.Println("Usage: imd-unpack source-file destination-file")
+		fmt.Println("       imd-unpack -info source-file")
 		os.Exit(1)
 	}
 
 	// get file names
 	source_fileName := args[0]
-	dest_filename := args[1]
 
-	// open the files
-	sfh, err := os.Open(source_fileName)
+	// read and decode the IMD file
+	data, err := ioutil.ReadFile(source_fileName)
 	utils.CheckAndExit(err)
 
-	defer sfh.Close()
-
-	dfh, err := os.Create(dest_filename)
+	image, err := imd.Decode(data)
 	utils.CheckAndExit(err)
 
-	// read IMD header
-	header := ""
-	b := make([]byte, 1)
-
-	for b[0] != 0x1a {
-		_, err = sfh.Read(b)
-		utils.CheckAndExit(err)
-
-		b0 := b[0]
-
-		// TODO: strip non-printable characters
-
-		header += string(b0)
+	if info {
+		printInfo(image)
+		os.Exit(0)
 	}
 
-	// display header
-	fmt.Println(header)
+	dest_filename := args[1]
 
-	eof := false
+	// display header
+	fmt.Println(imd.Sanitize(image.Header))
 
-	for !eof {
-		// if index mod 10 == 0, read track header
-		// TODO: use number of sectors to find next header (start with zero)
+	// sectors go in sector number order, not file order
+	unpacked, sectors := image.Linear()
 
-		sector_map, err := read_track_header(sfh)
-		if err == io.EOF {
-			eof = true
-		} else {
-			utils.CheckAndExit(err)
+	missing := 0
+	for _, sector := range sectors {
+		if len(sector.Status()) > 0 {
+			fmt.Printf("Cylinder %d head %d sector %d: %s\n", sector.Cylinder, sector.Head, sector.Number, sector.Status())
 		}
 
-		num_sectors := len(sector_map)
-		for i := 0; i < num_sectors; i++ {
-			sector, err := read_sector(sfh)
-			if err == io.EOF {
-				eof = true
-			} else {
-				utils.CheckAndExit(err)
-			}
-
-			if !eof {
-				dfh.Write(sector)
-			}
+		if sector.Missing {
+			missing += 1
 		}
 	}
+
+	if missing > 0 {
+		fmt.Printf("%d sector(s) missing, filled with %s\n", missing, imd.MissingPattern)
+	}
+
+	err = ioutil.WriteFile(dest_filename, unpacked, 0644)
+	utils.CheckAndExit(err)
 }
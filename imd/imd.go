@@ -0,0 +1,685 @@
+/*
+Package imd of H-8/H-89 disk reader
+*/
+package imd
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/jfitz/h8d-examiner/utils"
+	"strings"
+	"time"
+)
+
+// Signature starts every ImageDisk file
+const Signature = "IMD "
+
+// the header text ends with CTRL-Z
+const headerEnd = 0x1a
+
+// flags in the head byte of a track header
+const cylinderMapFlag = 0x80
+const headMapFlag = 0x40
+
+// size code for a table of sector sizes after the maps
+const sizeTableCode = 0xff
+
+// Sector is one sector record of a track
+type Sector struct {
+	Number     int // from the sector numbering map
+	Cylinder   int // from the cylinder map, or the track cylinder
+	Head       int // from the head map, or the track head
+	Size       int
+	Data       []byte // empty when not available
+	Available  bool   // false when the data could not be read (record type 0x00)
+	Missing    bool   // not in the file, but expected from the other sectors of the track
+	Compressed bool   // all bytes the same, stored once
+	Deleted    bool   // written with a deleted-data address mark
+	DataError  bool   // read with a CRC error
+}
+
+// Good reports a sector whose data can be trusted
+func (sector Sector) Good() bool {
+	return sector.Available && !sector.DataError
+}
+
+// Status describes a sector that is not plain good data
+func (sector Sector) Status() string {
+	if sector.Missing {
+		return "missing"
+	}
+
+	if !sector.Available {
+		return "unavailable"
+	}
+
+	status := []string{}
+
+	if sector.Deleted {
+		status = append(status, "deleted")
+	}
+
+	if sector.DataError {
+		status = append(status, "CRC error")
+	}
+
+	return strings.Join(status, ", ")
+}
+
+// Track is one track record, with its sectors in file order
+type Track struct {
+	Mode      int // recording mode and data rate, 0 to 5
+	Cylinder  int
+	Head      int
+	SizeCode  int // 128 << code bytes per sector, or 0xFF for a table of sizes
+	SectorMap []int
+	Sectors   []Sector
+}
+
+// Image is a decoded ImageDisk file
+type Image struct {
+	Header string // version line, date and comment, as stored
+	Tracks []Track
+}
+
+// IsIMD reports data that starts with the ImageDisk signature
+func IsIMD(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(Signature))
+}
+
+// reads the file in order, and reports where a problem is found
+type reader struct {
+	data   []byte
+	offset int
+}
+
+func (r *reader) bytes(count int, what string) ([]byte, error) {
+	if r.offset+count > len(r.data) {
+		return []byte{}, utils.IMDFormatError{Offset: r.offset, Problem: "file ends in " + what}
+	}
+
+	bs := r.data[r.offset : r.offset+count]
+	r.offset += count
+
+	return bs, nil
+}
+
+func (r *reader) byte(what string) (int, error) {
+	bs, err := r.bytes(1, what)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(bs[0]), nil
+}
+
+// sector record types 0x01 to 0x08 are combinations of three flags
+func (r *reader) readSector(sector *Sector) error {
+	recordOffset := r.offset
+
+	recordType, err := r.byte("sector record")
+	if err != nil {
+		return err
+	}
+
+	if recordType == 0x00 {
+		return nil
+	}
+
+	if recordType > 0x08 {
+		return utils.IMDFormatError{Offset: recordOffset, Problem: fmt.Sprintf("unknown sector record type %02X", recordType)}
+	}
+
+	flags := recordType - 1
+	sector.Available = true
+	sector.Compressed = flags&1 != 0
+	sector.Deleted = flags&2 != 0
+	sector.DataError = flags&4 != 0
+
+	if sector.Compressed {
+		fill, err := r.byte("compressed sector")
+		if err != nil {
+			return err
+		}
+
+		sector.Data = bytes.Repeat([]byte{byte(fill)}, sector.Size)
+	} else {
+		data, err := r.bytes(sector.Size, "sector data")
+		if err != nil {
+			return err
+		}
+
+		sector.Data = append([]byte{}, data...)
+	}
+
+	return nil
+}
+
+func (r *reader) readTrack() (Track, error) {
+	track := Track{}
+	headerOffset := r.offset
+
+	header, err := r.bytes(5, "track header")
+	if err != nil {
+		return track, err
+	}
+
+	track.Mode = int(header[0])
+	track.Cylinder = int(header[1])
+	track.Head = int(header[2] & 0x0f)
+	sectorCount := int(header[3])
+	track.SizeCode = int(header[4])
+
+	if track.Mode > 5 {
+		return track, utils.IMDFormatError{Offset: headerOffset, Problem: fmt.Sprintf("unknown mode %02X", track.Mode)}
+	}
+
+	if track.SizeCode > 6 && track.SizeCode != sizeTableCode {
+		return track, utils.IMDFormatError{Offset: headerOffset + 4, Problem: fmt.Sprintf("unknown sector size code %02X", track.SizeCode)}
+	}
+
+	sectorMap, err := r.bytes(sectorCount, "sector numbering map")
+	if err != nil {
+		return track, err
+	}
+
+	cylinderMap := []byte{}
+	if header[2]&cylinderMapFlag != 0 {
+		cylinderMap, err = r.bytes(sectorCount, "cylinder map")
+		if err != nil {
+			return track, err
+		}
+	}
+
+	headMap := []byte{}
+	if header[2]&headMapFlag != 0 {
+		headMap, err = r.bytes(sectorCount, "head map")
+		if err != nil {
+			return track, err
+		}
+	}
+
+	// sizes are 128 << code, or 16-bit values from the table
+	sizes := []int{}
+	if track.SizeCode == sizeTableCode {
+		table, err := r.bytes(sectorCount*2, "sector size table")
+		if err != nil {
+			return track, err
+		}
+
+		for i := 0; i < sectorCount; i++ {
+			sizes = append(sizes, int(table[i*2])+int(table[i*2+1])*256)
+		}
+	} else {
+		for i := 0; i < sectorCount; i++ {
+			sizes = append(sizes, 128<<uint(track.SizeCode))
+		}
+	}
+
+	for i := 0; i < sectorCount; i++ {
+		track.SectorMap = append(track.SectorMap, int(sectorMap[i]))
+
+		sector := Sector{
+			Number:   int(sectorMap[i]),
+			Cylinder: track.Cylinder,
+			Head:     track.Head,
+			Size:     sizes[i],
+		}
+
+		if len(cylinderMap) > 0 {
+			sector.Cylinder = int(cylinderMap[i])
+		}
+
+		if len(headMap) > 0 {
+			sector.Head = int(headMap[i])
+		}
+
+		err = r.readSector(&sector)
+		if err != nil {
+			return track, err
+		}
+
+		track.Sectors = append(track.Sectors, sector)
+	}
+
+	return track, nil
+}
+
+// Decode reads an ImageDisk file: the header text, then track records to the end
+func Decode(data []byte) (Image, error) {
+	image := Image{}
+
+	if !IsIMD(data) {
+		return image, utils.IMDFormatError{Offset: 0, Problem: "no IMD signature"}
+	}
+
+	end := bytes.IndexByte(data, headerEnd)
+	if end < 0 {
+		return image, utils.IMDFormatError{Offset: len(data), Problem: "header does not end"}
+	}
+
+	image.Header = string(data[:end])
+
+	r := reader{data: data, offset: end + 1}
+
+	for r.offset < len(data) {
+		track, err := r.readTrack()
+		if err != nil {
+			return image, err
+		}
+
+		image.Tracks = append(image.Tracks, track)
+	}
+
+	return image, nil
+}
+
+// MissingPattern fills sectors that are not in the file, so they stand out in a dump
+const MissingPattern = "<MISSING SECTOR>"
+
+// first sector number of the track, 0 or 1
+func (track Track) base() int {
+	for _, number := range track.SectorMap {
+		if number == 0 {
+			return 0
+		}
+	}
+
+	return 1
+}
+
+// number of sector positions in the track, from the highest sector number
+func (track Track) positionCount() int {
+	count := len(track.Sectors)
+
+	for _, number := range track.SectorMap {
+		if number-track.base()+1 > count {
+			count = number - track.base() + 1
+		}
+	}
+
+	return count
+}
+
+// sectors in the order of their numbers, with missing ones filled in
+func (track Track) placed(count int) []Sector {
+	positions := make([]Sector, count)
+	filled := make([]bool, count)
+
+	size := 128 << uint(track.SizeCode)
+	if len(track.Sectors) > 0 {
+		size = track.Sectors[0].Size
+	}
+
+	for _, sector := range track.Sectors {
+		position := sector.Number - track.base()
+
+		// a repeated sector number keeps the first good copy
+		if filled[position] && (positions[position].Good() || !sector.Good()) {
+			continue
+		}
+
+		positions[position] = sector
+		filled[position] = true
+	}
+
+	for position := range positions {
+		if !filled[position] {
+			positions[position] = Sector{
+				Number:   position + track.base(),
+				Cylinder: track.Cylinder,
+				Head:     track.Head,
+				Size:     size,
+				Missing:  true,
+			}
+		}
+	}
+
+	return positions
+}
+
+// Linear returns the sectors of every track in file order, each track in sector number order
+// tracks are padded to the most sectors found in any track
+// the data of unavailable sectors is zero, and of missing sectors is MissingPattern
+func (image Image) Linear() ([]byte, []Sector) {
+	data := []byte{}
+	sectors := []Sector{}
+
+	count := 0
+	for _, track := range image.Tracks {
+		if track.positionCount() > count {
+			count = track.positionCount()
+		}
+	}
+
+	for _, track := range image.Tracks {
+		for _, sector := range track.placed(count) {
+			sectorData := sector.Data
+			if sector.Missing {
+				sectorData = bytes.Repeat([]byte(MissingPattern), sector.Size/len(MissingPattern)+1)[:sector.Size]
+			} else if !sector.Available {
+				sectorData = make([]byte, sector.Size)
+			}
+
+			data = append(data, sectorData...)
+			sectors = append(sectors, sector)
+		}
+	}
+
+	return data, sectors
+}
+
+// Geometry is the layout of a flat image to encode as IMD
+type Geometry struct {
+	Sides           int
+	Tracks          int // tracks per side
+	SectorsPerTrack int
+	SectorSize      int // 128 << size code
+	FirstSector     int // 0 or 1
+	Interleave      int // 1 for sectors in order
+	Mode            int // 0 to 5, as in the track header
+}
+
+// SectorMap returns the sector numbers in the order they pass the head
+func SectorMap(count int, interleave int, first int) []int {
+	sectorMap := make([]int, count)
+	used := make([]bool, count)
+
+	position := 0
+	for number := 0; number < count; number++ {
+		for used[position] {
+			position = (position + 1) % count
+		}
+
+		sectorMap[position] = number + first
+		used[position] = true
+		position = (position + interleave) % count
+	}
+
+	return sectorMap
+}
+
+func sizeCode(size int) (int, error) {
+	for code := 0; code <= 6; code++ {
+		if 128<<uint(code) == size {
+			return code, nil
+		}
+	}
+
+	return 0, fmt.Errorf("Sector size %d is not 128, 256, ... 8192", size)
+}
+
+// FromImage builds an IMD image from a flat image with sectors in number order
+// tracks are in cylinder order, both sides of a cylinder together
+func FromImage(data []byte, geometry Geometry, header string) (Image, error) {
+	image := Image{Header: header}
+
+	code, err := sizeCode(geometry.SectorSize)
+	if err != nil {
+		return image, err
+	}
+
+	if geometry.Sides < 1 || geometry.Sides > 2 {
+		return image, fmt.Errorf("Sides %d is not 1 or 2", geometry.Sides)
+	}
+
+	// the sector count of a track header is one byte
+	if geometry.SectorsPerTrack < 1 || geometry.SectorsPerTrack > 255 {
+		return image, fmt.Errorf("Sectors per track %d is not 1 to 255", geometry.SectorsPerTrack)
+	}
+
+	if geometry.FirstSector != 0 && geometry.FirstSector != 1 {
+		return image, fmt.Errorf("First sector %d is not 0 or 1", geometry.FirstSector)
+	}
+
+	if geometry.Tracks < 1 {
+		return image, fmt.Errorf("Tracks %d is less than 1", geometry.Tracks)
+	}
+
+	if geometry.Mode < 0 || geometry.Mode > 5 {
+		return image, fmt.Errorf("Mode %d is not 0 to 5", geometry.Mode)
+	}
+
+	if geometry.Interleave < 1 || (geometry.Interleave >= geometry.SectorsPerTrack && geometry.Interleave != 1) {
+		return image, fmt.Errorf("Interleave %d is not 1 to %d", geometry.Interleave, geometry.SectorsPerTrack-1)
+	}
+
+	trackSize := geometry.SectorsPerTrack * geometry.SectorSize
+	if len(data) != geometry.Sides*geometry.Tracks*trackSize {
+		return image, fmt.Errorf("Image has %d bytes, geometry needs %d", len(data), geometry.Sides*geometry.Tracks*trackSize)
+	}
+
+	sectorMap := SectorMap(geometry.SectorsPerTrack, geometry.Interleave, geometry.FirstSector)
+
+	for cylinder := 0; cylinder < geometry.Tracks; cylinder++ {
+		for head := 0; head < geometry.Sides; head++ {
+			track := Track{
+				Mode:      geometry.Mode,
+				Cylinder:  cylinder,
+				Head:      head,
+				SizeCode:  code,
+				SectorMap: sectorMap,
+			}
+
+			trackStart := (cylinder*geometry.Sides + head) * trackSize
+
+			for _, number := range sectorMap {
+				start := trackStart + (number-geometry.FirstSector)*geometry.SectorSize
+
+				track.Sectors = append(track.Sectors, Sector{
+					Number:    number,
+					Cylinder:  cylinder,
+					Head:      head,
+					Size:      geometry.SectorSize,
+					Data:      data[start : start+geometry.SectorSize],
+					Available: true,
+				})
+			}
+
+			image.Tracks = append(image.Tracks, track)
+		}
+	}
+
+	return image, nil
+}
+
+// Header returns the version line of an IMD file, with a comment after it
+func Header(created time.Time, comment string) string {
+	header := fmt.Sprintf("IMD 1.18: %2d/%02d/%04d %02d:%02d:%02d", created.Day(), int(created.Month()), created.Year(), created.Hour(), created.Minute(), created.Second())
+
+	for _, line := range strings.Split(comment, "\n") {
+		header += "\r\n" + strings.TrimRight(line, "\r")
+	}
+
+	return header
+}
+
+func uniform(data []byte) bool {
+	for _, b := range data {
+		if b != data[0] {
+			return false
+		}
+	}
+
+	return len(data) > 0
+}
+
+// record type 0x00 for no data, then 0x01 to 0x08 from the flags
+func (sector Sector) record() []byte {
+	if !sector.Available || sector.Missing {
+		return []byte{0x00}
+	}
+
+	recordType := 1
+	if sector.Deleted {
+		recordType += 2
+	}
+
+	if sector.DataError {
+		recordType += 4
+	}
+
+	// sectors of one repeated byte are compressed
+	if uniform(sector.Data) {
+		return []byte{byte(recordType + 1), sector.Data[0]}
+	}
+
+	return append([]byte{byte(recordType)}, sector.Data...)
+}
+
+func (track Track) encode() []byte {
+	cylinderMap := []byte{}
+	headMap := []byte{}
+	sectorMap := []byte{}
+	sizeTable := []byte{}
+
+	needCylinderMap := false
+	needHeadMap := false
+
+	for _, sector := range track.Sectors {
+		sectorMap = append(sectorMap, byte(sector.Number))
+		cylinderMap = append(cylinderMap, byte(sector.Cylinder))
+		headMap = append(headMap, byte(sector.Head))
+		sizeTable = append(sizeTable, byte(sector.Size%256), byte(sector.Size/256))
+
+		needCylinderMap = needCylinderMap || sector.Cylinder != track.Cylinder
+		needHeadMap = needHeadMap || sector.Head != track.Head
+	}
+
+	head := byte(track.Head)
+	if needCylinderMap {
+		head |= cylinderMapFlag
+	}
+
+	if needHeadMap {
+		head |= headMapFlag
+	}
+
+	bs := []byte{byte(track.Mode), byte(track.Cylinder), head, byte(len(track.Sectors)), byte(track.SizeCode)}
+	bs = append(bs, sectorMap...)
+
+	if needCylinderMap {
+		bs = append(bs, cylinderMap...)
+	}
+
+	if needHeadMap {
+		bs = append(bs, headMap...)
+	}
+
+	if track.SizeCode == sizeTableCode {
+		bs = append(bs, sizeTable...)
+	}
+
+	for _, sector := range track.Sectors {
+		bs = append(bs, sector.record()...)
+	}
+
+	return bs
+}
+
+// Encode returns the bytes of an IMD file: header, CTRL-Z, then the tracks
+func (image Image) Encode() []byte {
+	bs := append([]byte(image.Header), headerEnd)
+
+	for _, track := range image.Tracks {
+		bs = append(bs, track.encode()...)
+	}
+
+	return bs
+}
+
+// Sanitize keeps the printable characters and line breaks of header text
+func Sanitize(text string) string {
+	clean := ""
+
+	for _, c := range strings.Replace(text, "\r\n", "\n", -1) {
+		if c == '\n' || (c >= ' ' && c <= '~') {
+			clean += string(c)
+		}
+	}
+
+	return clean
+}
+
+// first line of the header, "IMD 1.18: dd/mm/yyyy hh:mm:ss"
+func (image Image) versionLine() string {
+	return strings.SplitN(Sanitize(image.Header), "\n", 2)[0]
+}
+
+// Version is the ImageDisk version that wrote the file
+func (image Image) Version() string {
+	line := strings.TrimPrefix(image.versionLine(), Signature)
+
+	return strings.TrimSpace(strings.SplitN(line, ":", 2)[0])
+}
+
+// Date is the date and time the file was written, as stored
+func (image Image) Date() string {
+	parts := strings.SplitN(image.versionLine(), ":", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+
+	return strings.TrimSpace(parts[1])
+}
+
+// Comment is the free text after the version line
+func (image Image) Comment() string {
+	lines := strings.SplitN(Sanitize(image.Header), "\n", 2)
+	if len(lines) < 2 {
+		return ""
+	}
+
+	return strings.TrimRight(lines[1], "\n ")
+}
+
+// ModeText describes the recording mode of a track
+func ModeText(mode int) string {
+	rates := []string{"500", "300", "250"}
+
+	if mode < 0 || mode > 5 {
+		return "unknown"
+	}
+
+	if mode < 3 {
+		return rates[mode] + " kbps FM"
+	}
+
+	return rates[mode-3] + " kbps MFM"
+}
+
+// Interleave is the most common distance on the track from each sector to the next numbered one
+func (track Track) Interleave() int {
+	count := len(track.SectorMap)
+
+	positions := map[int]int{}
+	for position, number := range track.SectorMap {
+		positions[number] = position
+	}
+
+	distances := map[int]int{}
+	for position, number := range track.SectorMap {
+		next, ok := positions[number+1]
+		if ok {
+			distances[(next-position+count)%count] += 1
+		}
+	}
+
+	interleave := 1
+	for distance, times := range distances {
+		if times > distances[interleave] || (times == distances[interleave] && distance < interleave) {
+			interleave = distance
+		}
+	}
+
+	return interleave
+}
+
+// SectorSize is the size of the sectors of the track (the first one, for a table of sizes)
+func (track Track) SectorSize() int {
+	if track.SizeCode == sizeTableCode && len(track.Sectors) > 0 {
+		return track.Sectors[0].Size
+	}
+
+	return 128 << uint(track.SizeCode)
+}
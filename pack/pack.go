@@ -0,0 +1,225 @@
+/*
+Package pack of H-8/H-89 disk reader
+*/
+package pack
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jfitz/h8d-examiner/cpm"
+	"github.com/jfitz/h8d-examiner/hdos"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// File is a host file to write, with the metadata written by export (if any)
+type File struct {
+	HostFile string
+	User     int // CP/M user area, from a subdirectory named 1 to 31
+	Metadata json.RawMessage
+}
+
+// a manifest as written by export with -metadata manifest
+func readManifest(manifestFilename string) ([]File, error) {
+	files := []File{}
+
+	contents, err := ioutil.ReadFile(manifestFilename)
+	if err != nil {
+		return files, err
+	}
+
+	err = json.Unmarshal(contents, &files)
+	if err != nil {
+		return files, err
+	}
+
+	// host files are next to the manifest
+	directory := filepath.Dir(manifestFilename)
+	for i := range files {
+		files[i].HostFile = filepath.Join(directory, files[i].HostFile)
+	}
+
+	return files, nil
+}
+
+// a subdirectory named for a CP/M user (as written by export), or 0
+func userDirectory(name string) int {
+	user, err := strconv.Atoi(name)
+	if err != nil || user < 1 || user > 31 || strconv.Itoa(user) != name {
+		return 0
+	}
+
+	return user
+}
+
+// every file in a directory, in name order, with its sidecar (NAME.EXT.json) if there is one
+// files in the subdirectories 1 to 31 follow, for those CP/M users
+func readDirectory(directory string) ([]File, error) {
+	files, err := readFiles(directory, 0)
+	if err != nil {
+		return files, err
+	}
+
+	infos, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return files, err
+	}
+
+	for _, info := range infos {
+		user := userDirectory(info.Name())
+		if !info.IsDir() || user == 0 {
+			continue
+		}
+
+		userFiles, err := readFiles(filepath.Join(directory, info.Name()), user)
+		if err != nil {
+			return files, err
+		}
+
+		files = append(files, userFiles...)
+	}
+
+	return files, nil
+}
+
+// the files of one directory, in name order
+func readFiles(directory string, user int) ([]File, error) {
+	files := []File{}
+
+	infos, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return files, err
+	}
+
+	for _, info := range infos {
+		name := info.Name()
+
+		// disk names cannot end in .json, so those are sidecars and manifests
+		if info.IsDir() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		file := File{HostFile: filepath.Join(directory, name), User: user}
+
+		metadata, err := ioutil.ReadFile(file.HostFile + ".json")
+		if err == nil {
+			file.Metadata = metadata
+		}
+
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// ReadSource lists the files of a host directory or a manifest
+func ReadSource(source string) ([]File, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return []File{}, err
+	}
+
+	if info.IsDir() {
+		return readDirectory(source)
+	}
+
+	return readManifest(source)
+}
+
+// HDOS writes the files into a blank HDOS image
+// files without dates in their metadata get the given date
+func HDOS(data []byte, files []File, date time.Time) error {
+	for _, file := range files {
+		options := hdos.ImportOptions{
+			Name: strings.ToUpper(filepath.Base(file.HostFile)),
+			Date: date,
+		}
+
+		if len(file.Metadata) > 0 {
+			metadata := hdos.FileMetadata{}
+			err := json.Unmarshal(file.Metadata, &metadata)
+			if err != nil {
+				return fmt.Errorf("%s: %s", file.HostFile, err.Error())
+			}
+
+			options, err = metadata.ImportOptions()
+			if err != nil {
+				return fmt.Errorf("%s: %s", file.HostFile, err.Error())
+			}
+		}
+
+		// HDOS has no user areas
+		if file.User != 0 {
+			fmt.Printf("%s: skipped, user areas are CP/M only\n", file.HostFile)
+			continue
+		}
+
+		// the blank image has its own
+		if hdos.IsSystemFile(options.Name) {
+			fmt.Printf("%s: skipped, made by init\n", file.HostFile)
+			continue
+		}
+
+		err := writeFile(file, func(contents []byte) error {
+			return hdos.WriteFile(data, contents, options)
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s: written as %s\n", file.HostFile, options.Name)
+	}
+
+	return nil
+}
+
+// CPM writes the files into a blank CP/M image
+func CPM(data []byte, files []File, dpb cpm.DiskParameterBlock) error {
+	for _, file := range files {
+		options := cpm.ImportOptions{Name: filepath.Base(file.HostFile)}
+		if file.User != 0 {
+			options.Name = fmt.Sprintf("%d:%s", file.User, options.Name)
+		}
+
+		if len(file.Metadata) > 0 {
+			metadata := cpm.FileMetadata{}
+			err := json.Unmarshal(file.Metadata, &metadata)
+			if err != nil {
+				return fmt.Errorf("%s: %s", file.HostFile, err.Error())
+			}
+
+			options, err = metadata.ImportOptions()
+			if err != nil {
+				return fmt.Errorf("%s: %s", file.HostFile, err.Error())
+			}
+		}
+
+		err := writeFile(file, func(contents []byte) error {
+			return cpm.WriteFile(data, contents, options, dpb)
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s: written as %s\n", file.HostFile, options.Name)
+	}
+
+	return nil
+}
+
+func writeFile(file File, write func([]byte) error) error {
+	contents, err := ioutil.ReadFile(file.HostFile)
+	if err == nil {
+		err = write(contents)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %s", file.HostFile, err.Error())
+	}
+
+	return nil
+}
@@ -20,32 +20,43 @@ func help() {
 	fmt.Println("hex   - show dump in hex")
 }
 
-func dumpSector(data []byte, sectorIndex int, base string) error {
-	start1 := sectorIndex * 256
-	end1 := start1 + 256
-	sector := data[start1:end1]
+func dumpSector(disk utils.Disk, sectorIndex int, base string) error {
+	if sectorIndex < 0 || sectorIndex >= disk.SectorCount() {
+		return utils.SectorRangeError{Sector: sectorIndex, SectorCount: disk.SectorCount()}
+	}
+
+	sector := disk.Sectors[sectorIndex]
+
+	// sectors an IMD file marked as bad or unavailable
+	if len(sector.Status) > 0 {
+		fmt.Printf("Bad sector: %s\n", sector.Status)
+	}
 
-	return utils.Dump(sector, sectorIndex, base)
+	return utils.Dump(sector.Bytes, sectorIndex, base)
 }
 
-func Menu(reader *bufio.Reader, data []byte) {
+func Menu(reader *bufio.Reader, disk utils.Disk) error {
 	// set default values
 	base := "hex"
 	sectorIndex := 0
 	lastWasDump := false
 
 	numberPattern, err := regexp.Compile("^\\d+$")
-	utils.CheckAndExit(err)
+	if err != nil {
+		return err
+	}
 
 	// display the first sector
-	err = dumpSector(data, sectorIndex, base)
-	utils.CheckAndExit(err)
+	err = dumpSector(disk, sectorIndex, base)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
 	fmt.Println()
 	lastWasDump = true
 
-	fileSize := len(data)
+	fileSectorCount := disk.SectorCount()
+	fileSize := fileSectorCount * 256
 	fileSizeInK := fileSize / 1024
-	fileSectorCount := fileSize / 256
 	fileLastSector := fileSectorCount - 1
 
 	// prompt for command and process it
@@ -54,7 +65,9 @@ func Menu(reader *bufio.Reader, data []byte) {
 		// display prompt and read command
 		fmt.Printf("SECTOR> ")
 		line, err := reader.ReadString('\n')
-		utils.CheckAndExit(err)
+		if err != nil {
+			return err
+		}
 
 		// process the command
 		line = strings.TrimSpace(line)
@@ -72,29 +85,37 @@ func Menu(reader *bufio.Reader, data []byte) {
 				sectorIndex += 1
 			}
 
-			err = dumpSector(data, sectorIndex, base)
-			utils.CheckAndExit(err)
+			err = dumpSector(disk, sectorIndex, base)
+			if err != nil {
+				fmt.Println(err.Error())
+			}
 			fmt.Println()
 			lastWasDump = true
 		} else if numberPattern.MatchString(line) {
 			sectorIndex, _ = strconv.Atoi(line)
 
-			err = dumpSector(data, sectorIndex, base)
-			utils.CheckAndExit(err)
+			err = dumpSector(disk, sectorIndex, base)
+			if err != nil {
+				fmt.Println(err.Error())
+			}
 			fmt.Println()
 			lastWasDump = true
 		} else if line == "octal" {
 			base = "octal"
 
-			err = dumpSector(data, sectorIndex, base)
-			utils.CheckAndExit(err)
+			err = dumpSector(disk, sectorIndex, base)
+			if err != nil {
+				fmt.Println(err.Error())
+			}
 			fmt.Println()
 			lastWasDump = true
 		} else if line == "hex" {
 			base = "hex"
 
-			err = dumpSector(data, sectorIndex, base)
-			utils.CheckAndExit(err)
+			err = dumpSector(disk, sectorIndex, base)
+			if err != nil {
+				fmt.Println(err.Error())
+			}
 			fmt.Println()
 			lastWasDump = true
 		} else {
@@ -102,4 +123,6 @@ func Menu(reader *bufio.Reader, data []byte) {
 			fmt.Println()
 		}
 	}
+
+	return nil
 }
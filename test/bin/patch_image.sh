@@ -0,0 +1,15 @@
+#!/bin/bash
+
+# copy an image and change single bytes of the copy (patch_image.sh SOURCE DEST OFFSET BYTE ...)
+SOURCE=$1
+DEST=$2
+shift 2
+
+mkdir -p "$(dirname "$DEST")"
+cp "$SOURCE" "$DEST"
+
+while [ $# -ge 2 ]
+do
+    printf "\\x$2" | dd of="$DEST" bs=1 seek=$1 conv=notrunc status=none
+    shift 2
+done
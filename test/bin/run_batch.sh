@@ -0,0 +1,35 @@
+#!/bin/bash
+
+echo
+TESTROOT=$1
+TESTBED=$2
+TESTGROUP=$3
+TESTNAME=$4
+PROGRAM=$5
+shift 5
+
+echo Start test $TESTNAME
+
+# create testbed (the program may write files there)
+echo Create testbed...
+mkdir "$TESTBED/$TESTNAME"
+
+# run the program with the remaining arguments, capture output and exit status
+echo Running $PROGRAM...
+go run $PROGRAM "$@" </dev/null >$TESTBED/$TESTNAME/stdout.txt
+echo "Exit status: $?" >>$TESTBED/$TESTNAME/stdout.txt
+
+# compare output
+echo Compare output...
+diff "$TESTROOT/$TESTGROUP/ref/$TESTNAME.txt" "$TESTBED/$TESTNAME/stdout.txt"
+((ECODE=$?))
+
+# if different copy stdout to ref directory
+if [ $ECODE -ne 0 ]
+then
+    ((NUM_FAIL+=1))
+    cp "$TESTBED/$TESTNAME/stdout.txt" "$TESTROOT/$TESTGROUP/ref/$TESTNAME.txt"
+fi
+
+echo End test $TESTNAME
+exit $NUM_FAIL
@@ -0,0 +1,48 @@
+#!/bin/bash
+
+echo
+TESTROOT=$1
+TESTBED=$2
+TESTGROUP=$3
+TESTNAME=$4
+FORMAT=$5
+SOURCE=$6
+NAME=$7
+
+echo Start test $TESTNAME
+
+# create testbed
+echo Create testbed...
+mkdir "$TESTBED/$TESTNAME"
+
+# import the file into a blank CP/M image, then export it with its metadata
+echo Running import and export...
+STDOUT="$TESTBED/$TESTNAME/stdout.txt"
+IMAGE="$TESTBED/$TESTNAME/image.h8d"
+FILES="$TESTBED/$TESTNAME/files"
+go run h8d-examiner.go -cpm -init "$FORMAT" "$IMAGE" </dev/null >"$STDOUT"
+echo "Exit status: $?" >>"$STDOUT"
+go run h8d-examiner.go -cpm -import "$SOURCE" -name "$NAME" "$IMAGE" </dev/null >>"$STDOUT"
+echo "Exit status: $?" >>"$STDOUT"
+go run h8d-examiner.go -cpm -export "$NAME" -directory "$FILES" -metadata sidecar "$IMAGE" </dev/null >>"$STDOUT"
+echo "Exit status: $?" >>"$STDOUT"
+
+# the exported file must be the original
+echo Compare with $SOURCE >>"$STDOUT"
+cmp "$SOURCE" "$FILES/$NAME" >>"$STDOUT"
+cat "$FILES/$NAME.json" >>"$STDOUT"
+
+# compare output
+echo Compare output...
+diff "$TESTROOT/$TESTGROUP/ref/$TESTNAME.txt" "$STDOUT"
+((ECODE=$?))
+
+# if different copy stdout to ref directory
+if [ $ECODE -ne 0 ]
+then
+    ((NUM_FAIL+=1))
+    cp "$STDOUT" "$TESTROOT/$TESTGROUP/ref/$TESTNAME.txt"
+fi
+
+echo End test $TESTNAME
+exit $NUM_FAIL
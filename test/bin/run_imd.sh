@@ -0,0 +1,46 @@
+#!/bin/bash
+
+echo
+TESTROOT=$1
+TESTBED=$2
+TESTGROUP=$3
+TESTNAME=$4
+SOURCE=$5
+shift 5
+
+echo Start test $TESTNAME
+
+# create testbed
+echo Create testbed...
+mkdir "$TESTBED/$TESTNAME"
+
+# pack the image with the remaining arguments, then unpack it
+echo Running imd-pack and imd-unpack...
+STDOUT="$TESTBED/$TESTNAME/stdout.txt"
+IMDFILE="$TESTBED/$TESTNAME/packed.IMD"
+H8DFILE="$TESTBED/$TESTNAME/unpacked.h8d"
+go run imd-pack.go "$@" "$SOURCE" "$IMDFILE" </dev/null >"$STDOUT"
+echo "Exit status: $?" >>"$STDOUT"
+
+# the first header line holds the time of packing
+go run imd-unpack.go "$IMDFILE" "$H8DFILE" </dev/null | sed 1d >>"$STDOUT"
+echo "Exit status: ${PIPESTATUS[0]}" >>"$STDOUT"
+
+# the unpacked image must be the original
+echo Compare with $SOURCE >>"$STDOUT"
+cmp "$SOURCE" "$H8DFILE" >>"$STDOUT"
+
+# compare output
+echo Compare output...
+diff "$TESTROOT/$TESTGROUP/ref/$TESTNAME.txt" "$STDOUT"
+((ECODE=$?))
+
+# if different copy stdout to ref directory
+if [ $ECODE -ne 0 ]
+then
+    ((NUM_FAIL+=1))
+    cp "$STDOUT" "$TESTROOT/$TESTGROUP/ref/$TESTNAME.txt"
+fi
+
+echo End test $TESTNAME
+exit $NUM_FAIL
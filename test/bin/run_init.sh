@@ -0,0 +1,49 @@
+#!/bin/bash
+
+echo
+TESTROOT=$1
+TESTBED=$2
+TESTGROUP=$3
+TESTNAME=$4
+LAYOUT=$5
+REFERENCE=$6
+LABEL=$7
+SERIAL=$8
+RGT=$9
+DIRFIRST=${10}
+GRT=${11}
+
+echo Start test $TESTNAME
+
+# create testbed
+echo Create testbed...
+mkdir "$TESTBED/$TESTNAME"
+
+# make a blank image like the one made by INIT.ABS
+echo Running h8d-examiner...
+H8DFILE="$TESTBED/$TESTNAME/$LAYOUT.h8d"
+go run h8d-examiner.go -init $LAYOUT -label "$LABEL" -serial $SERIAL -date 00-JAN-1970 "$H8DFILE" >/dev/null
+
+# list the bytes that differ in the label fields, the RGT, and the directory groups and GRT
+STDOUT="$TESTBED/$TESTNAME/stdout.txt"
+echo Label >"$STDOUT"
+cmp -l -i 2304:2304 -n 80 "$REFERENCE" "$H8DFILE" >>"$STDOUT"
+echo RGT >>"$STDOUT"
+cmp -l -i $((RGT * 256)):$((RGT * 256)) -n 256 "$REFERENCE" "$H8DFILE" >>"$STDOUT"
+echo Directory and GRT >>"$STDOUT"
+cmp -l -i $((DIRFIRST * 256)):$((DIRFIRST * 256)) -n $(((GRT - DIRFIRST + 1) * 256)) "$REFERENCE" "$H8DFILE" >>"$STDOUT"
+
+# compare output
+echo Compare output...
+diff "$TESTROOT/$TESTGROUP/ref/$TESTNAME.txt" "$STDOUT"
+((ECODE=$?))
+
+# if different copy stdout to ref directory
+if [ $ECODE -ne 0 ]
+then
+    ((NUM_FAIL+=1))
+    cp "$STDOUT" "$TESTROOT/$TESTGROUP/ref/$TESTNAME.txt"
+fi
+
+echo End test $TESTNAME
+exit $NUM_FAIL
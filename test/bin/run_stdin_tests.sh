@@ -29,6 +29,10 @@ test/bin/run_stdin.sh test tests EmptyHDOSImages 1s80t-cat test/EmptyHDOSImages/
 test/bin/run_stdin.sh test tests EmptyHDOSImages 1s40t-dir test/EmptyHDOSImages/data/1s40t.h8d test/bin/stdin_hdos_dir.txt
 test/bin/run_stdin.sh test tests EmptyHDOSImages 1s80t-dir test/EmptyHDOSImages/data/1s80t.h8d test/bin/stdin_hdos_dir.txt
 
+# dates (HDOS 1.5 distribution disk, 10-JUN-1979)
+test/bin/run_stdin.sh test tests HDOS hdos15-stats "test/HDOS/HDOS_1-5_Issue_#50-04-00_890-1-4.h8d" test/bin/stdin_hdos_stats.txt
+test/bin/run_stdin.sh test tests HDOS hdos15-cat "test/HDOS/HDOS_1-5_Issue_#50-04-00_890-1-4.h8d" test/bin/stdin_hdos_cat.txt
+
 # CP/M
 # stats
 test/bin/run_stdin.sh test tests CPM_Apps c80_1-stats test/CPM_Apps/data/C80CPM1.h8d test/bin/stdin_cpm_stats.txt
@@ -44,3 +48,138 @@ test/bin/run_stdin.sh test tests CPM_Apps c80_3-cat test/CPM_Apps/data/C80CPM3.h
 test/bin/run_stdin.sh test tests CPM_Apps c80_1-dir test/CPM_Apps/data/C80CPM1.h8d test/bin/stdin_cpm_dir.txt
 test/bin/run_stdin.sh test tests CPM_Apps c80_2-dir test/CPM_Apps/data/C80CPM2.h8d test/bin/stdin_cpm_dir.txt
 test/bin/run_stdin.sh test tests CPM_Apps c80_3-dir test/CPM_Apps/data/C80CPM3.h8d test/bin/stdin_cpm_dir.txt
+
+# export (wildcards, existing files are skipped; a copy of C80CPM1 with C.COM in user 3
+# exports it to a subdirectory)
+test/bin/run_batch.sh test tests CPM_Apps export-c80_1-com h8d-examiner.go -export '*.COM' -directory tests/export-c80_1-com/files test/CPM_Apps/data/C80CPM1.h8d
+test/bin/run_batch.sh test tests CPM_Apps export-c80_1-skip h8d-examiner.go -export 'C*.*' -directory tests/export-c80_1-com/files test/CPM_Apps/data/C80CPM1.h8d
+test/bin/patch_image.sh test/CPM_Apps/data/C80CPM1.h8d tests/users/C80CPM1.h8d 7712 03 7744 03 7776 03
+test/bin/run_batch.sh test tests CPM_Apps users-export h8d-examiner.go -export '*' -directory tests/users-export/files tests/users/C80CPM1.h8d
+
+# metadata (sidecar files or a manifest next to the exported files)
+test/bin/run_batch.sh test tests HDOS metadata-hdos15-manifest h8d-examiner.go -export '*' -metadata manifest -directory tests/metadata-hdos15-manifest/files "test/HDOS/HDOS_1-5_Issue_#50-04-00_890-1-4.h8d"
+test/bin/run_batch.sh test tests CPM_Apps metadata-c80_1-sidecar h8d-examiner.go -export '*' -metadata sidecar -directory tests/metadata-c80_1-sidecar/files test/CPM_Apps/data/C80CPM1.h8d
+
+# HDOS import (on a copy of a blank disk; an empty file gets one zeroed sector, as HDOS writes it)
+test/bin/patch_image.sh test/EmptyHDOSImages/data/1s40t.h8d tests/import/import.h8d
+test/bin/run_batch.sh test tests EmptyHDOSImages import-text h8d-examiner.go -import test/bin/stdin_hdos_cat.txt -name CAT.TXT -flags W -project 2 -version 5 -date 20-JUN-1981 tests/import/import.h8d
+test/bin/run_batch.sh test tests EmptyHDOSImages import-again h8d-examiner.go -hdos -import test/bin/stdin_hdos_cat.txt -name CAT.TXT tests/import/import.h8d
+test/bin/run_batch.sh test tests EmptyHDOSImages import-big h8d-examiner.go -hdos -import test/HDOS/ref/hdos15-cat.txt -name BIG.TXT -date 21-JUN-1981 tests/import/import.h8d
+test/bin/run_batch.sh test tests EmptyHDOSImages import-empty h8d-examiner.go -hdos -import test/bin/empty.txt -name EMPTY.TXT -date 22-JUN-1981 tests/import/import.h8d
+test/bin/run_stdin.sh test tests EmptyHDOSImages import-cat tests/import/import.h8d test/bin/stdin_hdos_cat.txt
+test/bin/run_stdin.sh test tests EmptyHDOSImages import-type tests/import/import.h8d test/bin/stdin_hdos_type.txt
+
+# CP/M import (on a copy of a HUG disk; a file of several entries keeps its attributes,
+# a format with too large an EXM and a -format larger than the image are refused)
+test/bin/patch_image.sh test/HUGLibrary/885-8012_Maple_CPM.h8d tests/cpm-import/import.h8d
+test/bin/run_batch.sh test tests CPM_Apps cpm-import-text h8d-examiner.go -import test/bin/stdin_cpm_cat.txt -name CAT.TXT tests/cpm-import/import.h8d
+test/bin/run_batch.sh test tests CPM_Apps cpm-import-again h8d-examiner.go -cpm -import test/bin/stdin_cpm_cat.txt -name CAT.TXT tests/cpm-import/import.h8d
+test/bin/run_batch.sh test tests CPM_Apps cpm-import-big h8d-examiner.go -cpm -import test/HUGLibrary/885-1225-37B_CPM_Disk_Dump_And_Edit_Utility.IMD -name 3:BIG.DAT -flags WA tests/cpm-import/import.h8d
+test/bin/run_batch.sh test tests CPM_Apps cpm-import-full h8d-examiner.go -cpm -import test/EmptyHDOSImages/data/1s40t.h8d -name FULL.DAT tests/cpm-import/import.h8d
+test/bin/run_stdin.sh test tests CPM_Apps cpm-import-cat tests/cpm-import/import.h8d test/bin/stdin_cpm_cat.txt
+test/bin/run_stdin.sh test tests CPM_Apps cpm-import-dir tests/cpm-import/import.h8d test/bin/stdin_cpm_dir.txt
+test/bin/run_batch.sh test tests CPM_Apps cpm-import-bad-exm h8d-examiner.go -cpm -formatfile test/bin/formats_bad_exm.json -format h37-ssdd-exm3 -import test/bin/stdin_cpm_cat.txt -name BAD.TXT tests/cpm-import/import.h8d
+test/bin/patch_image.sh test/HUGLibrary/885-1207_CPM_Term_HTOC.h8d tests/copies/885-1207_CPM_Term_HTOC.h8d
+test/bin/run_batch.sh test tests CPM_Apps cpm-import-format h8d-examiner.go -cpm -format h17-dssd -import test/bin/stdin_cpm_cat.txt -name ZZ.TXT tests/copies/885-1207_CPM_Term_HTOC.h8d
+
+# HDOS delete and rename (on the imported image, CAT.TXT is write protected,
+# names match in any case, the system files stay even when forced)
+test/bin/run_stdin.sh test tests EmptyHDOSImages delete-rename tests/import/import.h8d test/bin/stdin_hdos_delete.txt
+
+# CP/M era, ren and set (on the imported image, every extent of BIG.DAT changes)
+test/bin/run_stdin.sh test tests CPM_Apps era-ren-set tests/cpm-import/import.h8d test/bin/stdin_cpm_era.txt
+
+# init (compared with the images made by INIT.ABS)
+test/bin/run_init.sh test tests EmptyHDOSImages init-1s40t 1s40t test/EmptyHDOSImages/data/1s40t.h8d "empty disk image:  1 side,  40 tracks" 17 10 130 148
+test/bin/run_init.sh test tests EmptyHDOSImages init-1s80t 1s80t test/EmptyHDOSImages/data/1s80t.h8d "empty disk image:  1 side,  80 tracks" 18 12 260 280
+test/bin/run_init.sh test tests EmptyHDOSImages init-2s40t 2s40t test/EmptyHDOSImages/data/2s40t.h8d "empty disk image: 2 sides,  40 cylinders  (80 tracks)" 33 12 260 280
+test/bin/run_init.sh test tests EmptyHDOSImages init-2s80t 2s80t test/EmptyHDOSImages/data/2s80t.h8d "empty disk image: 2 sides,  80 cylinders (160 tracks)" 34 16 520 544
+test/bin/run_init.sh test tests EmptyHDOSImages init-1s102t 1s102t test/EmptyHDOSImages/data/1s102t.h8d "empty disk image:  1 side, 102 tracks" 19 12 260 280
+test/bin/run_init.sh test tests EmptyHDOSImages init-1s160t 1s160t test/EmptyHDOSImages/data/1s160t.h8d "empty disk image:  1 side, 160 tracks" 20 16 520 544
+test/bin/run_init.sh test tests EmptyHDOSImages init-1s204t 1s204t test/EmptyHDOSImages/data/1s204t.h8d "empty disk image:  1 side, 204 tracks" 21 16 520 544
+test/bin/run_init.sh test tests EmptyHDOSImages init-2s102t 2s102t test/EmptyHDOSImages/data/2s102t.h8d "empty disk image: 2 sides, !02 cylinders (204 tracks)" 37 16 520 544
+test/bin/run_stdin.sh test tests EmptyHDOSImages init-1s40t-stats tests/init-1s40t/1s40t.h8d test/bin/stdin_hdos_stats.txt
+test/bin/run_stdin.sh test tests EmptyHDOSImages init-1s40t-cat tests/init-1s40t/1s40t.h8d test/bin/stdin_hdos_cat.txt
+test/bin/run_stdin.sh test tests EmptyHDOSImages init-1s80t-stats tests/init-1s80t/1s80t.h8d test/bin/stdin_hdos_stats.txt
+test/bin/run_stdin.sh test tests EmptyHDOSImages init-1s80t-cat tests/init-1s80t/1s80t.h8d test/bin/stdin_hdos_cat.txt
+test/bin/run_stdin.sh test tests EmptyHDOSImages init-2s80t-stats tests/init-2s80t/2s80t.h8d test/bin/stdin_hdos_stats.txt
+test/bin/run_stdin.sh test tests EmptyHDOSImages init-2s80t-cat tests/init-2s80t/2s80t.h8d test/bin/stdin_hdos_cat.txt
+
+# CP/M init (blank volumes open in the CP/M menu; the system tracks come from a template)
+test/bin/run_batch.sh test tests CPM_Apps init-h17-sssd h8d-examiner.go -cpm -init h17-sssd -template test/HUGLibrary/885-1210_CPM_HUG_Editor.h8d tests/init-h17-sssd/blank.h8d
+test/bin/run_stdin.sh test tests CPM_Apps init-h17-sssd-blank tests/init-h17-sssd/blank.h8d test/bin/stdin_cpm_blank.txt
+test/bin/run_batch.sh test tests CPM_Apps init-h37-dsdd80 h8d-examiner.go -cpm -init h37-dsdd80 tests/init-h37-dsdd80/blank.h8d
+test/bin/run_stdin.sh test tests CPM_Apps init-h37-dsdd80-blank tests/init-h37-dsdd80/blank.h8d test/bin/stdin_cpm_blank.txt
+test/bin/run_batch.sh test tests CPM_Apps init-again h8d-examiner.go -cpm -init h17-sssd tests/init-h17-sssd/blank.h8d
+# a file over 512K has entries with S2 set (six HUG images make 600K)
+mkdir tests/big
+cat test/HUGLibrary/885-1010_Adventure.h8d test/HUGLibrary/885-1019_HDOS_1-6_Device_Drivers.h8d test/HUGLibrary/885-1022_Editor.h8d test/HUGLibrary/885-1023_RTTY-8.h8d test/HUGLibrary/885-1024_Disk_I_Misc.h8d test/HUGLibrary/885-1025_Runoff.h8d >tests/big/big.dat
+test/bin/run_cpm_roundtrip.sh test tests CPM_Apps cpm-import-s2 h37-dsdd80 tests/big/big.dat BIG.DAT
+
+# pack (packed back into a blank image, the dates, flags, attributes and users are kept;
+# from a plain directory the files go in name order, with the -date date)
+test/bin/run_batch.sh test tests HDOS metadata-hdos15-pack h8d-examiner.go -init 1s40t -label "HDOS 1.5" -date 10-JUN-1979 -pack tests/metadata-hdos15-manifest/files/manifest.json tests/metadata-hdos15-pack/hdos15.h8d
+test/bin/run_stdin.sh test tests HDOS metadata-hdos15-pack-cat tests/metadata-hdos15-pack/hdos15.h8d test/bin/stdin_hdos_cat.txt
+test/bin/run_batch.sh test tests CPM_Apps metadata-c80_1-pack h8d-examiner.go -cpm -init h17-sssd -pack tests/metadata-c80_1-sidecar/files tests/metadata-c80_1-pack/c80_1.h8d
+test/bin/run_stdin.sh test tests CPM_Apps metadata-c80_1-pack-cat tests/metadata-c80_1-pack/c80_1.h8d test/bin/stdin_cpm_cat.txt
+test/bin/run_batch.sh test tests CPM_Apps users-pack h8d-examiner.go -cpm -init h17-sssd -pack tests/users-export/files tests/users-pack/users.h8d
+test/bin/run_batch.sh test tests CPM_Apps users-pack-cat h8d-examiner.go -cat tests/users-pack/users.h8d
+test/bin/run_batch.sh test tests HDOS pack-hdos15-export h8d-examiner.go -export '*' -directory tests/pack-hdos15-export/files "test/HDOS/HDOS_1-5_Issue_#50-04-00_890-1-4.h8d"
+test/bin/run_batch.sh test tests HDOS pack-hdos15-directory h8d-examiner.go -init 1s40t -label "HDOS 1.5 files" -date 01-JAN-1980 -pack tests/pack-hdos15-export/files tests/pack-hdos15-directory/hdos15.h8d
+test/bin/run_stdin.sh test tests HDOS pack-hdos15-directory-cat tests/pack-hdos15-directory/hdos15.h8d test/bin/stdin_hdos_cat.txt
+
+# HDOS check (885-1086 has a bad directory link and broken GRT chains)
+test/bin/run_stdin.sh test tests HUGLibrary tiny-pascal-check test/HUGLibrary/885-1086_HDOS_Tiny_Pascal.h8d test/bin/stdin_hdos_check.txt
+test/bin/run_stdin.sh test tests HUGLibrary adventure-check test/HUGLibrary/885-1010_Adventure.h8d test/bin/stdin_hdos_check.txt
+
+# CP/M check (a copy of C80CPM1 with a missing extent, blocks beyond DSM, in the directory and
+# used twice, a record count over 128 and a name that is not printable; the exit status is 1)
+test/bin/patch_image.sh test/CPM_Apps/data/C80CPM1.h8d tests/damaged/C80CPM1.h8d 7788 03 7824 30 7887 90 7906 07 7709 f0 7858 01
+test/bin/run_stdin.sh test tests CPM_Apps damaged-check tests/damaged/C80CPM1.h8d test/bin/stdin_cpm_check.txt
+test/bin/run_batch.sh test tests CPM_Apps damaged-check-batch h8d-examiner.go -check tests/damaged/C80CPM1.h8d
+test/bin/run_stdin.sh test tests CPM_Apps c80_1-check test/CPM_Apps/data/C80CPM1.h8d test/bin/stdin_cpm_check.txt
+test/bin/run_batch.sh test tests CPM_Apps c80_1-check-batch h8d-examiner.go -check test/CPM_Apps/data/C80CPM1.h8d
+# batch -check of the HDOS images
+test/bin/run_batch.sh test tests HUGLibrary tiny-pascal-check-batch h8d-examiner.go -check test/HUGLibrary/885-1086_HDOS_Tiny_Pascal.h8d
+test/bin/run_batch.sh test tests HUGLibrary adventure-check-batch h8d-examiner.go -check test/HUGLibrary/885-1010_Adventure.h8d
+
+# repair (the copy is written next to the test output; the original is not changed,
+# a CP/M file ends before a released block, so CLIBRARY.ASM keeps its first two blocks)
+# 885-1086 has a directory block overwritten with text, so it is refused
+test/bin/run_batch.sh test tests HUGLibrary tiny-pascal-repair h8d-examiner.go -repair tests/tiny-pascal-repair/repaired.h8d test/HUGLibrary/885-1086_HDOS_Tiny_Pascal.h8d
+test/bin/run_batch.sh test tests HUGLibrary tiny-pascal-check-after h8d-examiner.go -check test/HUGLibrary/885-1086_HDOS_Tiny_Pascal.h8d
+# a copy of 885-1010 with a looping chain, a chain into another file and a wrong last group
+test/bin/patch_image.sh test/HUGLibrary/885-1010_Adventure.h8d tests/damaged/885-1010_Adventure.h8d 60948 11 61088 14 56849 0b
+test/bin/run_batch.sh test tests HUGLibrary adventure-damaged-check h8d-examiner.go -check tests/damaged/885-1010_Adventure.h8d
+test/bin/run_batch.sh test tests HUGLibrary adventure-repair h8d-examiner.go -repair tests/adventure-repair/repaired.h8d tests/damaged/885-1010_Adventure.h8d
+test/bin/run_batch.sh test tests HUGLibrary adventure-repaired-check h8d-examiner.go -check tests/adventure-repair/repaired.h8d
+test/bin/run_batch.sh test tests CPM_Apps damaged-repair h8d-examiner.go -repair tests/damaged-repair/repaired.h8d tests/damaged/C80CPM1.h8d
+test/bin/run_batch.sh test tests CPM_Apps damaged-repaired-check h8d-examiner.go -check tests/damaged-repair/repaired.h8d
+test/bin/run_stdin.sh test tests CPM_Apps damaged-repaired-type tests/damaged-repair/repaired.h8d test/bin/stdin_cpm_type.txt
+test/bin/run_batch.sh test tests CPM_Apps damaged-repair-again h8d-examiner.go -repair tests/damaged-repair/repaired.h8d tests/damaged/C80CPM1.h8d
+
+# IMD unpack (sectors that could not be read are listed)
+test/bin/run_batch.sh test tests HUGLibrary unpack-1217 imd-unpack.go test/HUGLibrary/885-1217-37_CPM_Disk_Duplication_Utilities.IMD tests/unpack-1217/unpacked.h8d
+test/bin/run_stdin.sh test tests HUGLibrary unpack-1217-dir tests/unpack-1217/unpacked.h8d test/bin/stdin_cpm_dir.txt
+test/bin/run_batch.sh test tests IMD unpack-bad-1024 imd-unpack.go test/IMD/data/bad-1024.IMD tests/unpack-bad-1024/unpacked.h8d
+
+# IMD sector map (sectors go in number order, a missing sector is filled with <MISSING SECTOR>)
+test/bin/run_batch.sh test tests IMD unpack-map imd-unpack.go test/IMD/data/map.IMD tests/unpack-map/unpacked.h8d
+test/bin/run_stdin.sh test tests IMD unpack-map-sector tests/unpack-map/unpacked.h8d test/bin/stdin_sector_map.txt
+
+# IMD opened directly (a bad 1024-byte sector marks the four 256-byte sectors it holds)
+test/bin/run_stdin.sh test tests HUGLibrary imd-1217-dir test/HUGLibrary/885-1217-37_CPM_Disk_Duplication_Utilities.IMD test/bin/stdin_cpm_dir.txt
+test/bin/run_stdin.sh test tests IMD bad-1024-sector test/IMD/data/bad-1024.IMD test/bin/stdin_sector_bad.txt
+
+# imd-pack (unpacked again, the image is unchanged; bad geometry is refused)
+test/bin/run_imd.sh test tests IMD pack-adventure test/HUGLibrary/885-1010_Adventure.h8d
+test/bin/run_imd.sh test tests IMD pack-c80_1 test/CPM_Apps/data/C80CPM1.h8d -first 1 -interleave 3 -mode 1 -comment "HUG disk"
+test/bin/run_batch.sh test tests IMD pack-bad-sides imd-pack.go -sides 0 test/CPM_Apps/data/C80CPM1.h8d tests/pack-bad-sides/packed.IMD
+test/bin/run_batch.sh test tests IMD pack-bad-tracks imd-pack.go -tracks -1 test/CPM_Apps/data/C80CPM1.h8d tests/pack-bad-tracks/packed.IMD
+test/bin/run_batch.sh test tests IMD pack-bad-sectors imd-pack.go -sectors -10 test/CPM_Apps/data/C80CPM1.h8d tests/pack-bad-sectors/packed.IMD
+test/bin/run_batch.sh test tests IMD pack-bad-first imd-pack.go -first 2 test/CPM_Apps/data/C80CPM1.h8d tests/pack-bad-first/packed.IMD
+
+# IMD info (header and track table, nothing written)
+test/bin/run_batch.sh test tests HUGLibrary info-1217 imd-unpack.go -info test/HUGLibrary/885-1217-37_CPM_Disk_Duplication_Utilities.IMD
+test/bin/run_batch.sh test tests HUGLibrary info-1226 imd-unpack.go -info test/HUGLibrary/885-1226-37_CPM_Utilities_By_PS.IMD
+test/bin/run_batch.sh test tests IMD info-bad-1024 imd-unpack.go -info test/IMD/data/bad-1024.IMD
@@ -0,0 +1,108 @@
+/*
+Package utils of H-8/H-89 disk reader
+*/
+package utils
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrFileNotFound = errors.New("File not found")
+var ErrFileExists = errors.New("File already exists")
+var ErrDiskFull = errors.New("Disk full")
+var ErrDirectoryFull = errors.New("Directory full")
+var ErrFileProtected = errors.New("File is locked or write-protected")
+var ErrSystemFile = errors.New("System files cannot be deleted or renamed")
+var ErrReadOnlyImage = errors.New("IMD images cannot be changed, unpack with imd-unpack first")
+var ErrLabelDamaged = errors.New("Label is damaged, cannot repair")
+var ErrDirectoryDamaged = errors.New("Directory chain is damaged, cannot repair")
+
+// SectorRangeError reports a sector that is not in the disk image
+type SectorRangeError struct {
+	Sector      int
+	SectorCount int
+}
+
+func (e SectorRangeError) Error() string {
+	return fmt.Sprintf("Sector %d out of range (image has %d sectors)", e.Sector, e.SectorCount)
+}
+
+// DirectoryLinkError reports a directory chain that leaves the disk or loops
+type DirectoryLinkError struct {
+	Sector int
+	Link   int
+}
+
+func (e DirectoryLinkError) Error() string {
+	return fmt.Sprintf("Bad directory link %d in directory sector %d", e.Link, e.Sector)
+}
+
+// AllocationBlockError reports an allocation block (CP/M) or group (HDOS) that is not on the disk
+type AllocationBlockError struct {
+	Block     int
+	LastBlock int
+}
+
+func (e AllocationBlockError) Error() string {
+	return fmt.Sprintf("Bad allocation block %d (last block is %d)", e.Block, e.LastBlock)
+}
+
+// ChainLoopError reports an allocation chain that does not end
+type ChainLoopError struct {
+	Start int
+}
+
+func (e ChainLoopError) Error() string {
+	return fmt.Sprintf("Allocation chain starting at %d does not end", e.Start)
+}
+
+// RecordCountError reports a directory entry with more records than its blocks can hold
+type RecordCountError struct {
+	RecordCount int
+	MaxRecords  int
+}
+
+func (e RecordCountError) Error() string {
+	return fmt.Sprintf("Record count %d exceeds allocated records %d", e.RecordCount, e.MaxRecords)
+}
+
+// BlockSlotsError reports more blocks than the slots of a CP/M directory entry can hold
+type BlockSlotsError struct {
+	Blocks int
+	Slots  int
+}
+
+func (e BlockSlotsError) Error() string {
+	return fmt.Sprintf("%d blocks do not fit in %d block slots", e.Blocks, e.Slots)
+}
+
+// ImageSizeError reports a disk image that is smaller than its format
+type ImageSizeError struct {
+	Format     string
+	Size       int
+	FormatSize int
+}
+
+func (e ImageSizeError) Error() string {
+	return fmt.Sprintf("Image has %d bytes, format %s needs %d", e.Size, e.Format, e.FormatSize)
+}
+
+// IMDFormatError reports an ImageDisk file that cannot be decoded
+type IMDFormatError struct {
+	Offset  int
+	Problem string
+}
+
+func (e IMDFormatError) Error() string {
+	return fmt.Sprintf("Bad IMD file at offset %04X: %s", e.Offset, e.Problem)
+}
+
+// ExportError reports files that could not be exported
+type ExportError struct {
+	Failed int
+}
+
+func (e ExportError) Error() string {
+	return fmt.Sprintf("%d file(s) not exported", e.Failed)
+}
@@ -0,0 +1,209 @@
+/*
+Package utils of H-8/H-89 disk reader
+*/
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type MetadataMode int
+
+const (
+	NoMetadata       MetadataMode = iota // file contents only
+	SidecarMetadata                      // NAME.EXT.json next to each file
+	ManifestMetadata                     // one manifest.json for the export
+)
+
+func ParseMetadataMode(text string) (MetadataMode, error) {
+	if text == "none" || text == "" {
+		return NoMetadata, nil
+	}
+
+	if text == "sidecar" {
+		return SidecarMetadata, nil
+	}
+
+	if text == "manifest" {
+		return ManifestMetadata, nil
+	}
+
+	return NoMetadata, errors.New("Metadata must be none, sidecar, or manifest")
+}
+
+func (mode MetadataMode) String() string {
+	if mode == SidecarMetadata {
+		return "sidecar"
+	}
+
+	if mode == ManifestMetadata {
+		return "manifest"
+	}
+
+	return "none"
+}
+
+// Describer is a file system that can describe a file (dates, flags, blocks) for export
+type Describer interface {
+	Describe(name string) (interface{}, error)
+}
+
+// ExportRecord is one exported file in a manifest
+type ExportRecord struct {
+	HostFile string
+	Metadata interface{}
+}
+
+// ExportSummary counts the files of a multi-file export
+type ExportSummary struct {
+	Written int
+	Skipped int
+	Failed  int
+}
+
+func (summary ExportSummary) Print() {
+	fmt.Printf("Written: %d  Skipped: %d  Failed: %d\n", summary.Written, summary.Skipped, summary.Failed)
+}
+
+// Exporter copies files from an image to a host directory, with their metadata
+type Exporter struct {
+	fileSystem      FileSystem
+	exportDirectory string
+	hostName        func(string) string
+	metadataMode    MetadataMode
+	manifest        []ExportRecord
+}
+
+// hostName converts a file name in the image to a host file name
+func (exporter *Exporter) Init(fileSystem FileSystem, exportDirectory string, hostName func(string) string, metadataMode MetadataMode) {
+	exporter.fileSystem = fileSystem
+	exporter.exportDirectory = exportDirectory
+	exporter.hostName = hostName
+	exporter.metadataMode = metadataMode
+	exporter.manifest = []ExportRecord{}
+}
+
+func writeJSON(filename string, value interface{}) error {
+	contents, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	contents = append(contents, '\n')
+
+	return ioutil.WriteFile(filename, contents, 0644)
+}
+
+// ExportFile copies one file, replacing any host file of the same name
+func (exporter *Exporter) ExportFile(filename string) error {
+	hostFilename := exporter.hostName(filename)
+	exportFilename := exporter.exportDirectory + "/" + hostFilename
+
+	// host names may have a directory (CP/M user areas)
+	err := os.MkdirAll(filepath.Dir(exportFilename), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = CopyFile(exporter.fileSystem, filename, exportFilename)
+	if err != nil || exporter.metadataMode == NoMetadata {
+		return err
+	}
+
+	describer, ok := exporter.fileSystem.(Describer)
+	if !ok {
+		return nil
+	}
+
+	metadata, err := describer.Describe(filename)
+	if err != nil {
+		return err
+	}
+
+	if exporter.metadataMode == SidecarMetadata {
+		return writeJSON(exportFilename+".json", metadata)
+	}
+
+	record := ExportRecord{HostFile: hostFilename, Metadata: metadata}
+	exporter.manifest = append(exporter.manifest, record)
+
+	return nil
+}
+
+// ExportFiles copies every file that matches a pattern
+// host files that already exist are skipped, not replaced
+func (exporter *Exporter) ExportFiles(pattern string) (ExportSummary, error) {
+	summary := ExportSummary{}
+
+	fileEntries, err := exporter.fileSystem.Entries()
+
+	for _, fileEntry := range fileEntries {
+		if !MatchFilename(pattern, fileEntry.Name) {
+			continue
+		}
+
+		exportFilename := exporter.exportDirectory + "/" + exporter.hostName(fileEntry.Name)
+
+		_, statErr := os.Stat(exportFilename)
+		if statErr == nil {
+			fmt.Printf("%s: skipped, file exists\n", fileEntry.Name)
+			summary.Skipped += 1
+			continue
+		}
+
+		exportErr := exporter.ExportFile(fileEntry.Name)
+		if exportErr == nil {
+			fmt.Printf("%s: written\n", fileEntry.Name)
+			summary.Written += 1
+		} else {
+			fmt.Printf("%s: %s\n", fileEntry.Name, exportErr.Error())
+			summary.Failed += 1
+		}
+	}
+
+	if err == nil && summary.Failed > 0 {
+		err = ExportError{Failed: summary.Failed}
+	}
+
+	return summary, err
+}
+
+// Close writes the manifest, if there is one
+// records already in the manifest are kept, unless the same host file was exported again
+func (exporter *Exporter) Close() error {
+	if exporter.metadataMode != ManifestMetadata || len(exporter.manifest) == 0 {
+		return nil
+	}
+
+	manifestFilename := exporter.exportDirectory + "/manifest.json"
+
+	manifest := []ExportRecord{}
+	contents, err := ioutil.ReadFile(manifestFilename)
+	if err == nil {
+		err = json.Unmarshal(contents, &manifest)
+		if err != nil {
+			return err
+		}
+	}
+
+	exported := map[string]bool{}
+	for _, record := range exporter.manifest {
+		exported[record.HostFile] = true
+	}
+
+	records := []ExportRecord{}
+	for _, record := range manifest {
+		if !exported[record.HostFile] {
+			records = append(records, record)
+		}
+	}
+
+	records = append(records, exporter.manifest...)
+
+	return writeJSON(manifestFilename, records)
+}
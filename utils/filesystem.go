@@ -0,0 +1,68 @@
+/*
+Package utils of H-8/H-89 disk reader
+*/
+package utils
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// FileEntry describes one file in a disk image
+type FileEntry struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	Sys     interface{}
+}
+
+// FileSystem is the common view of a disk image (HDOS, CP/M, ...)
+type FileSystem interface {
+	// list all files
+	Entries() ([]FileEntry, error)
+
+	// find one file by name
+	Stat(name string) (FileEntry, error)
+
+	// contents of one file
+	Open(name string) (io.ReadSeeker, error)
+
+	// unallocated space, in bytes
+	FreeSpace() (int64, error)
+}
+
+// copy one file from the image to the host file system
+func ExportFile(fileSystem FileSystem, filename string, exportDirectory string) error {
+	exportFilename := exportDirectory + "/" + filename
+
+	return CopyFile(fileSystem, filename, exportFilename)
+}
+
+// copy one file from the image to a named host file
+func CopyFile(fileSystem FileSystem, filename string, hostFilename string) error {
+	reader, err := fileSystem.Open(filename)
+	if err != nil {
+		return err
+	}
+
+	// open file
+	f, err := os.Create(hostFilename)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, reader)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	// keep the date of the file, when the disk has one
+	fileEntry, err := fileSystem.Stat(filename)
+	if err != nil || fileEntry.ModTime.IsZero() {
+		return nil
+	}
+
+	return os.Chtimes(hostFilename, fileEntry.ModTime, fileEntry.ModTime)
+}
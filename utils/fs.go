@@ -0,0 +1,231 @@
+/*
+Package utils of H-8/H-89 disk reader
+*/
+package utils
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"time"
+)
+
+// fileInfo implements fs.FileInfo for a FileEntry
+type fileInfo struct {
+	entry FileEntry
+}
+
+func (info fileInfo) Name() string {
+	return info.entry.Name
+}
+
+func (info fileInfo) Size() int64 {
+	return info.entry.Size
+}
+
+func (info fileInfo) Mode() fs.FileMode {
+	// disk images are mounted read-only
+	return 0444
+}
+
+func (info fileInfo) ModTime() time.Time {
+	return info.entry.ModTime
+}
+
+func (info fileInfo) IsDir() bool {
+	return false
+}
+
+func (info fileInfo) Sys() interface{} {
+	return info.entry.Sys
+}
+
+// rootInfo implements fs.FileInfo for the (only) directory
+type rootInfo struct{}
+
+func (info rootInfo) Name() string {
+	return "."
+}
+
+func (info rootInfo) Size() int64 {
+	return 0
+}
+
+func (info rootInfo) Mode() fs.FileMode {
+	return fs.ModeDir | 0555
+}
+
+func (info rootInfo) ModTime() time.Time {
+	return time.Time{}
+}
+
+func (info rootInfo) IsDir() bool {
+	return true
+}
+
+func (info rootInfo) Sys() interface{} {
+	return nil
+}
+
+// file implements fs.File (and io.Seeker) for one file in the image
+type file struct {
+	reader io.ReadSeeker
+	info   fileInfo
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	return f.reader.Read(b)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	return f.reader.Seek(offset, whence)
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+// rootDirectory implements fs.ReadDirFile for the root of the image
+type rootDirectory struct {
+	entries []fs.DirEntry
+	offset  int
+	err     error // a damaged directory, reported after the entries that could be read
+}
+
+func (dir *rootDirectory) Stat() (fs.FileInfo, error) {
+	return rootInfo{}, nil
+}
+
+func (dir *rootDirectory) Read(b []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: ".", Err: errors.New("is a directory")}
+}
+
+func (dir *rootDirectory) Close() error {
+	return nil
+}
+
+func (dir *rootDirectory) ReadDir(count int) ([]fs.DirEntry, error) {
+	remaining := dir.entries[dir.offset:]
+
+	if count <= 0 {
+		dir.offset = len(dir.entries)
+		return remaining, dir.err
+	}
+
+	if len(remaining) == 0 {
+		if dir.err != nil {
+			return []fs.DirEntry{}, dir.err
+		}
+
+		return []fs.DirEntry{}, io.EOF
+	}
+
+	if count > len(remaining) {
+		count = len(remaining)
+	}
+
+	dir.offset += count
+
+	return remaining[:count], nil
+}
+
+// FS presents a FileSystem as a flat fs.FS, fs.ReadDirFS and fs.StatFS
+type FS struct {
+	fileSystem FileSystem
+}
+
+func (fsys *FS) Init(fileSystem FileSystem) {
+	fsys.fileSystem = fileSystem
+}
+
+func pathError(op string, name string, err error) error {
+	if errors.Is(err, ErrFileNotFound) {
+		err = fs.ErrNotExist
+	}
+
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// the entries that could be read, and the first problem (as os.File.ReadDir does)
+func (fsys FS) readDir() ([]fs.DirEntry, error) {
+	fileEntries, err := fsys.fileSystem.Entries()
+
+	dirEntries := []fs.DirEntry{}
+
+	for _, fileEntry := range fileEntries {
+		dirEntries = append(dirEntries, fs.FileInfoToDirEntry(fileInfo{fileEntry}))
+	}
+
+	sort.Slice(dirEntries, func(i, j int) bool {
+		return dirEntries[i].Name() < dirEntries[j].Name()
+	})
+
+	return dirEntries, err
+}
+
+func (fsys FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathError("open", name, fs.ErrInvalid)
+	}
+
+	if name == "." {
+		dirEntries, err := fsys.readDir()
+		if err != nil {
+			err = pathError("readdir", name, err)
+		}
+
+		return &rootDirectory{entries: dirEntries, err: err}, nil
+	}
+
+	fileEntry, err := fsys.fileSystem.Stat(name)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+
+	reader, err := fsys.fileSystem.Open(name)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+
+	return &file{reader: reader, info: fileInfo{fileEntry}}, nil
+}
+
+func (fsys FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return []fs.DirEntry{}, pathError("readdir", name, fs.ErrInvalid)
+	}
+
+	// all files are in the root directory
+	if name != "." {
+		return []fs.DirEntry{}, pathError("readdir", name, fs.ErrNotExist)
+	}
+
+	dirEntries, err := fsys.readDir()
+	if err != nil {
+		return dirEntries, pathError("readdir", name, err)
+	}
+
+	return dirEntries, nil
+}
+
+func (fsys FS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathError("stat", name, fs.ErrInvalid)
+	}
+
+	if name == "." {
+		return rootInfo{}, nil
+	}
+
+	fileEntry, err := fsys.fileSystem.Stat(name)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+
+	return fileInfo{fileEntry}, nil
+}
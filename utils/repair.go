@@ -0,0 +1,30 @@
+/*
+Package utils of H-8/H-89 disk reader
+*/
+package utils
+
+import (
+	"fmt"
+)
+
+// SaveRepair prints the changes made by a repair and writes the repaired image to a new file
+// nothing is written when there are no changes
+func SaveRepair(fileName string, data []byte, changes []string) error {
+	if len(changes) == 0 {
+		fmt.Println("No repairs needed")
+		return nil
+	}
+
+	err := WriteNewFile(fileName, data)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+
+	fmt.Printf("%d change(s) written to %s\n", len(changes), fileName)
+
+	return nil
+}
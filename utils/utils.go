@@ -17,11 +17,33 @@ func CheckAndExit(e error) {
 	}
 }
 
-func EchoInput(s string) {
-	o, _ := os.Stdin.Stat()
+// WriteNewFile writes data to a file that must not already exist
+func WriteNewFile(fileName string, data []byte) error {
+	fh, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = fh.Write(data)
+	if err != nil {
+		fh.Close()
+		return err
+	}
+
+	return fh.Close()
+}
+
+func EchoInput(s string) error {
+	o, err := os.Stdin.Stat()
+	if err != nil {
+		return err
+	}
+
 	if (o.Mode() & os.ModeCharDevice) != os.ModeCharDevice {
 		fmt.Println(s)
 	}
+
+	return nil
 }
 
 func TrimSlice(slice []byte) []byte {
@@ -43,6 +65,10 @@ const (
 	H47 DiskType = 47
 )
 
+func (diskType DiskType) String() string {
+	return fmt.Sprintf("H-%d", int(diskType))
+}
+
 type DiskSides int
 
 const (
@@ -59,7 +85,8 @@ type DiskGeometry struct {
 }
 
 type Sector struct {
-	Bytes []byte
+	Bytes  []byte
+	Status string // why the data cannot be trusted (from an IMD file), empty if it can
 }
 
 func (sector *Sector) Init(bytes []byte) {
@@ -74,9 +101,13 @@ type Disk struct {
 	Sectors []Sector
 }
 
-func (disk *Disk) Init(bytes []byte) {
+func (disk *Disk) Init(bytes []byte) error {
 	sectorSize := 256
 
+	if len(bytes)%sectorSize != 0 {
+		return errors.New("Image size is not a multiple of the sector size")
+	}
+
 	for index := 0; index < len(bytes); index += sectorSize {
 		end := index + sectorSize
 		sectorBytes := bytes[index:end]
@@ -84,12 +115,36 @@ func (disk *Disk) Init(bytes []byte) {
 		sector.Init(sectorBytes)
 		disk.Sectors = append(disk.Sectors, sector)
 	}
+
+	return nil
 }
 
 func (disk Disk) SectorCount() (int) {
 	return len(disk.Sectors)
 }
 
+// SetStatus marks the sectors holding a range of bytes of the image as untrustworthy
+func (disk *Disk) SetStatus(offset int, size int, status string) {
+	// a 1024-byte IMD sector covers four sectors, a 128-byte one part of a sector
+	for index := offset / 256; index <= (offset+size-1)/256; index++ {
+		if index >= 0 && index < len(disk.Sectors) {
+			disk.Sectors[index].Status = status
+		}
+	}
+}
+
+// GetSector returns one 256-byte sector of an image
+func GetSector(data []byte, sectorIndex int) ([]byte, error) {
+	start := sectorIndex * 256
+	end := start + 256
+
+	if sectorIndex < 0 || end > len(data) {
+		return []byte{}, SectorRangeError{sectorIndex, len(data) / 256}
+	}
+
+	return data[start:end], nil
+}
+
 func ReadSector(fh *os.File, sectorIndex int) ([]byte, error) {
 	sector := make([]byte, 256)
 
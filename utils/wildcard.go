@@ -0,0 +1,87 @@
+/*
+Package utils of H-8/H-89 disk reader
+*/
+package utils
+
+import (
+	"strings"
+)
+
+// HasWildcards reports a file specification with * or ?
+func HasWildcards(spec string) bool {
+	return strings.ContainsAny(spec, "*?")
+}
+
+// split optional user number (U:NAME.EXT) from name
+func splitUser(filename string) (string, string) {
+	parts := strings.SplitN(filename, ":", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+
+	return "", filename
+}
+
+func splitExtension(filename string) (string, string) {
+	parts := strings.SplitN(filename, ".", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+
+	return filename, ""
+}
+
+// match one field (name or extension), padded with spaces to its width
+func matchField(pattern string, field string, width int) bool {
+	// * matches the rest of the field
+	star := strings.Index(pattern, "*")
+	if star > -1 {
+		pattern = pattern[:star]
+		if star < width {
+			pattern += strings.Repeat("?", width-star)
+		}
+	}
+
+	if len(field) > width {
+		width = len(field)
+	}
+
+	if len(pattern) > width {
+		width = len(pattern)
+	}
+
+	pattern += strings.Repeat(" ", width-len(pattern))
+	field += strings.Repeat(" ", width-len(field))
+
+	pattern = strings.ToUpper(pattern)
+	field = strings.ToUpper(field)
+
+	for i := 0; i < width; i++ {
+		if pattern[i] != '?' && pattern[i] != field[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// MatchFilename compares a file name with a CP/M-style pattern (*.ASM, GAME?.BAS)
+// a pattern of * alone matches every file on the disk
+func MatchFilename(pattern string, filename string) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	patternUser, patternName := splitUser(pattern)
+	user, name := splitUser(filename)
+
+	// user numbers are not wild
+	if patternUser != user {
+		return false
+	}
+
+	patternName, patternExtension := splitExtension(patternName)
+	name, extension := splitExtension(name)
+
+	return matchField(patternName, name, 8) && matchField(patternExtension, extension, 3)
+}